@@ -0,0 +1,244 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	valkey "github.com/gomodule/redigo/redis"
+)
+
+const (
+	invalidatorPingInterval = 5 * time.Second  // how often the subscription is pinged to check it's still alive
+	invalidatorTimeout      = 15 * time.Second // how long without hearing anything before the subscription is dropped
+	invalidatorRetryDelay   = time.Second      // how long to wait before resubscribing after the subscription drops
+)
+
+// Invalidatable is a cache which can have items removed from it by an invalidator.
+type Invalidatable[K comparable] interface {
+	Delete(K)
+	Clear()
+}
+
+// sharedInvalidatable is a cache with a tier shared between processes, like Tiered, which has items removed from that
+// tier by the process which publishes an invalidation and by every process which receives it, as the publisher may
+// not have such a cache itself
+type sharedInvalidatable[K comparable] interface {
+	deleteShared(context.Context, K) error
+	clearShared(context.Context) error
+}
+
+// Invalidator broadcasts invalidations of cached items over a valkey channel, so that every process which subscribes
+// its caches to the same channel removes stale items from them, rather than waiting for them to expire.
+//
+// If the subscription drops, e.g. because valkey restarted, it's resubscribed automatically, and the subscribed
+// caches are cleared as they may have missed invalidations in the meantime.
+//
+// Invalidations are published as JSON, so other services can publish them too. An item is invalidated with
+// {"key": <key>}, where the key is encoded as JSON, e.g. {"key": "abc"} or {"key": 123}, and everything with
+// {"all": true}.
+type Invalidator[K comparable] struct {
+	vp      *valkey.Pool
+	channel string
+
+	mutex  sync.RWMutex // guards caches
+	caches []Invalidatable[K]
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// invalidation is the message published for an invalidation, where keys are encoded as JSON
+type invalidation[K comparable] struct {
+	Key K    `json:"key"`
+	All bool `json:"all,omitempty"`
+}
+
+// NewInvalidator creates a new invalidator which uses the given valkey channel.
+func NewInvalidator[K comparable](vp *valkey.Pool, channel string) *Invalidator[K] {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &Invalidator[K]{vp: vp, channel: channel, ctx: ctx, cancel: cancel}
+}
+
+// Subscribe adds a cache which will have items removed from it when they're invalidated.
+func (i *Invalidator[K]) Subscribe(c Invalidatable[K]) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	i.caches = append(i.caches, c)
+}
+
+// Start starts the routine which listens for invalidations, returning immediately.
+func (i *Invalidator[K]) Start() {
+	i.wg.Add(1)
+
+	go func() {
+		defer i.wg.Done()
+
+		for first := true; ; first = false {
+			err := i.listen(!first)
+			if i.ctx.Err() != nil {
+				return
+			}
+
+			slog.Error("cache invalidation subscription dropped", "channel", i.channel, "error", err)
+
+			select {
+			case <-i.ctx.Done():
+				return
+			case <-time.After(invalidatorRetryDelay):
+			}
+		}
+	}()
+}
+
+// Stop stops that routine and waits for it to finish.
+func (i *Invalidator[K]) Stop() {
+	i.cancel()
+	i.wg.Wait()
+}
+
+// Invalidate removes the item with the given key from every subscribed cache, in this and other processes, including
+// from the valkey tier of tiered caches.
+func (i *Invalidator[K]) Invalidate(ctx context.Context, key K) error {
+	return i.publish(ctx, &invalidation[K]{Key: key})
+}
+
+// InvalidateAll clears every subscribed cache, in this and other processes, including the valkey tier of tiered caches.
+func (i *Invalidator[K]) InvalidateAll(ctx context.Context) error {
+	return i.publish(ctx, &invalidation[K]{All: true})
+}
+
+func (i *Invalidator[K]) publish(ctx context.Context, inv *invalidation[K]) error {
+	data, err := json.Marshal(inv)
+	if err != nil {
+		return fmt.Errorf("error encoding invalidation: %w", err)
+	}
+
+	// remove from shared tiers first so that other processes can't get the stale item from there once they've
+	// removed it from their own caches
+	if err := i.applyShared(ctx, inv); err != nil {
+		return err
+	}
+
+	// apply to our own caches immediately rather than waiting for the message to come back to us
+	i.apply(inv)
+
+	vc, err := i.vp.GetContext(ctx)
+	if err != nil {
+		return fmt.Errorf("error getting valkey connection: %w", err)
+	}
+	defer vc.Close()
+
+	if _, err := valkey.DoContext(vc, ctx, "PUBLISH", i.channel, data); err != nil {
+		return fmt.Errorf("error publishing invalidation: %w", err)
+	}
+	return nil
+}
+
+// listen subscribes to the channel and applies invalidations until the subscription drops or we're stopped
+func (i *Invalidator[K]) listen(resubscribe bool) error {
+	vc, err := i.vp.GetContext(i.ctx)
+	if err != nil {
+		return fmt.Errorf("error getting valkey connection: %w", err)
+	}
+
+	psc := valkey.PubSubConn{Conn: vc}
+	defer psc.Close()
+
+	if err := psc.Subscribe(i.channel); err != nil {
+		return fmt.Errorf("error subscribing: %w", err)
+	}
+
+	// pings ensure we hear something regularly even if nothing is being invalidated, and when we're stopped we
+	// unsubscribe so that the receive loop below ends
+	pingDone := make(chan struct{})
+	defer close(pingDone)
+
+	go func() {
+		ticker := time.NewTicker(invalidatorPingInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				psc.Ping("")
+			case <-i.ctx.Done():
+				psc.Unsubscribe()
+				return
+			case <-pingDone:
+				return
+			}
+		}
+	}()
+
+	for {
+		switch v := psc.ReceiveWithTimeout(invalidatorTimeout).(type) {
+		case valkey.Message:
+			inv := &invalidation[K]{}
+			if err := json.Unmarshal(v.Data, inv); err != nil {
+				slog.Error("error decoding cache invalidation", "channel", i.channel, "error", err)
+				continue
+			}
+
+			// deleting from a shared tier is idempotent, so it doesn't matter if other receivers do it too
+			if err := i.applyShared(i.ctx, inv); err != nil {
+				slog.Error("error applying cache invalidation to shared tier", "channel", i.channel, "error", err)
+			}
+			i.apply(inv)
+
+		case valkey.Subscription:
+			if v.Count == 0 {
+				return nil
+			}
+
+			// any invalidations published while we weren't subscribed have been missed
+			if resubscribe {
+				i.apply(&invalidation[K]{All: true})
+			}
+
+		case error:
+			return v
+		}
+	}
+}
+
+// apply applies the given invalidation to all subscribed caches
+func (i *Invalidator[K]) apply(inv *invalidation[K]) {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+
+	for _, c := range i.caches {
+		if inv.All {
+			c.Clear()
+		} else {
+			c.Delete(inv.Key)
+		}
+	}
+}
+
+// applyShared applies the given invalidation to the shared tiers of subscribed caches
+func (i *Invalidator[K]) applyShared(ctx context.Context, inv *invalidation[K]) error {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+
+	for _, c := range i.caches {
+		if sc, ok := c.(sharedInvalidatable[K]); ok {
+			var err error
+			if inv.All {
+				err = sc.clearShared(ctx)
+			} else {
+				err = sc.deleteShared(ctx, inv.Key)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,234 @@
+package cache_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	valkey "github.com/gomodule/redigo/redis"
+	"github.com/nyaruka/gocommon/cache"
+	"github.com/nyaruka/vkutil/assertvk"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInvalidator(t *testing.T) {
+	ctx := context.Background()
+	vp := assertvk.TestDB()
+
+	defer assertvk.FlushDB()
+
+	fetch := func(ctx context.Context, k int) (string, error) { return "fetched", nil }
+
+	// two invalidators on the same channel, like two processes
+	cache1 := cache.NewLocal[int, string](fetch, time.Minute)
+	inv1 := cache.NewInvalidator[int](vp, "test:invalidations")
+	inv1.Subscribe(cache1)
+	inv1.Start()
+	defer inv1.Stop()
+
+	cache2 := cache.NewLocal[int, string](fetch, time.Minute)
+	cache3 := cache.NewLocal[int, string](fetch, time.Minute)
+	inv2 := cache.NewInvalidator[int](vp, "test:invalidations")
+	inv2.Subscribe(cache2)
+	inv2.Subscribe(cache3)
+	inv2.Start()
+	defer inv2.Stop()
+
+	for _, c := range []*cache.Local[int, string]{cache1, cache2, cache3} {
+		c.Set(1, "one")
+		c.Set(2, "two")
+	}
+
+	// the publisher's own caches are invalidated immediately
+	assert.NoError(t, inv1.Invalidate(ctx, 1))
+	assert.Equal(t, "", cache1.Get(1))
+	assert.Equal(t, "two", cache1.Get(2))
+
+	// other processes' caches once they receive the invalidation, which they can only do once subscribed
+	assert.Eventually(t, func() bool {
+		inv1.Invalidate(ctx, 1)
+		return cache2.Get(1) == "" && cache3.Get(1) == ""
+	}, time.Second, 10*time.Millisecond)
+
+	assert.Equal(t, "two", cache2.Get(2))
+	assert.Equal(t, "two", cache3.Get(2))
+
+	// invalidate everything
+	assert.NoError(t, inv2.InvalidateAll(ctx))
+	assert.Equal(t, 0, cache2.Len())
+	assert.Equal(t, 0, cache3.Len())
+
+	assert.Eventually(t, func() bool { return cache1.Len() == 0 }, time.Second, 10*time.Millisecond)
+}
+
+func TestInvalidatorTiered(t *testing.T) {
+	ctx := context.Background()
+	vp := assertvk.TestDB()
+	vc := vp.Get()
+	defer vc.Close()
+
+	defer assertvk.FlushDB()
+
+	fetch := func(ctx context.Context, k string) (string, error) { return strings.ToUpper(k), nil }
+
+	// two tiered caches sharing the same valkey tier, like two processes
+	cache1 := cache.NewTiered[string, string](fetch, vp, "test:", time.Minute, time.Minute, nil)
+	inv1 := cache.NewInvalidator[string](vp, "test:invalidations")
+	inv1.Subscribe(cache1)
+	inv1.Start()
+	defer inv1.Stop()
+
+	cache2 := cache.NewTiered[string, string](fetch, vp, "test:", time.Minute, time.Minute, nil)
+	inv2 := cache.NewInvalidator[string](vp, "test:invalidations")
+	inv2.Subscribe(cache2)
+	inv2.Start()
+	defer inv2.Stop()
+
+	assertExists := func(key string, expected bool) {
+		t.Helper()
+		exists, err := valkey.Bool(vc.Do("EXISTS", key))
+		assert.NoError(t, err)
+		assert.Equal(t, expected, exists, "exists mismatch for %s", key)
+	}
+
+	for _, c := range []*cache.Tiered[string, string]{cache1, cache2} {
+		assert.NoError(t, c.Set(ctx, "a", "A/old"))
+		assert.NoError(t, c.Set(ctx, "b", "B/old"))
+	}
+
+	// items in other caches which share the valkey instance aren't touched by clearing, even if their keys start with
+	// this cache's prefix
+	_, err := vc.Do("SET", "other:a", "1")
+	assert.NoError(t, err)
+	_, err = vc.Do("SET", "test:other:a", "1")
+	assert.NoError(t, err)
+
+	// deleting an item from a tiered cache only removes it locally
+	cache1.Delete("a")
+	assertExists("test:a", true)
+
+	v, err := cache1.GetOrFetch(ctx, "a")
+	assert.NoError(t, err)
+	assert.Equal(t, "A/old", v)
+
+	// but invalidating it removes it from valkey too, so other processes refetch it rather than reading it from there
+	assert.NoError(t, inv1.Invalidate(ctx, "a"))
+	assertExists("test:a", false)
+	assertExists("test:b", true)
+
+	assert.Eventually(t, func() bool {
+		v, _ := cache2.GetOrFetch(ctx, "a")
+		return v == "A"
+	}, time.Second, 10*time.Millisecond)
+
+	// invalidating everything clears valkey of the cache's items
+	assert.NoError(t, inv2.InvalidateAll(ctx))
+	assertExists("test:a", false)
+	assertExists("test:b", false)
+	assertExists("test::keys", false)
+	assertExists("other:a", true)
+	assertExists("test:other:a", true)
+
+	assert.Eventually(t, func() bool {
+		v, _ := cache1.GetOrFetch(ctx, "b")
+		return v == "B"
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestInvalidatorTieredReceiver(t *testing.T) {
+	ctx := context.Background()
+	vp := assertvk.TestDB()
+	vc := vp.Get()
+	defer vc.Close()
+
+	defer assertvk.FlushDB()
+
+	fetch := func(ctx context.Context, k string) (string, error) { return strings.ToUpper(k), nil }
+
+	c := cache.NewTiered[string, string](fetch, vp, "test:", time.Minute, time.Minute, nil)
+	inv := cache.NewInvalidator[string](vp, "test:invalidations")
+	inv.Subscribe(c)
+	inv.Start()
+	defer inv.Stop()
+
+	assertExists := func(key string, expected bool) {
+		t.Helper()
+		exists, err := valkey.Bool(vc.Do("EXISTS", key))
+		assert.NoError(t, err)
+		assert.Equal(t, expected, exists, "exists mismatch for %s", key)
+	}
+
+	assert.NoError(t, c.Set(ctx, "a", "A/old"))
+	assert.NoError(t, c.Set(ctx, "b", "B/old"))
+
+	assert.Eventually(t, func() bool {
+		values, err := valkey.Values(vc.Do("PUBSUB", "NUMSUB", "test:invalidations"))
+		if err != nil || len(values) != 2 {
+			return false
+		}
+		n, _ := valkey.Int(values[1], nil)
+		return n == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// the publisher has no tiered cache of its own, so the receiver removes the item from valkey
+	publisher := cache.NewInvalidator[string](vp, "test:invalidations")
+	assert.NoError(t, publisher.Invalidate(ctx, "a"))
+
+	assert.Eventually(t, func() bool { return c.Len() == 1 }, time.Second, 10*time.Millisecond)
+	assertExists("test:a", false)
+	assertExists("test:b", true)
+
+	// as it does for invalidations published by other services
+	_, err := vc.Do("PUBLISH", "test:invalidations", `{"all":true}`)
+	assert.NoError(t, err)
+
+	assert.Eventually(t, func() bool { return c.Len() == 0 }, time.Second, 10*time.Millisecond)
+	assertExists("test:b", false)
+
+	v, err := c.GetOrFetch(ctx, "a")
+	assert.NoError(t, err)
+	assert.Equal(t, "A", v)
+}
+
+func TestInvalidatorResubscribe(t *testing.T) {
+	vp := assertvk.TestDB()
+	vc := vp.Get()
+	defer vc.Close()
+
+	defer assertvk.FlushDB()
+
+	fetch := func(ctx context.Context, k int) (string, error) { return "fetched", nil }
+
+	c := cache.NewLocal[int, string](fetch, time.Minute)
+	inv := cache.NewInvalidator[int](vp, "test:invalidations")
+	inv.Subscribe(c)
+	inv.Start()
+	defer inv.Stop()
+
+	subscribers := func() int {
+		values, err := valkey.Values(vc.Do("PUBSUB", "NUMSUB", "test:invalidations"))
+		assert.NoError(t, err)
+		n, _ := valkey.Int(values[1], nil)
+		return n
+	}
+
+	assert.Eventually(t, func() bool { return subscribers() == 1 }, time.Second, 10*time.Millisecond)
+
+	c.Set(1, "one")
+	c.Set(2, "two")
+
+	// kill the subscription's connection, e.g. as if valkey restarted
+	_, err := vc.Do("CLIENT", "KILL", "TYPE", "pubsub")
+	assert.NoError(t, err)
+
+	// it resubscribes, and clears the cache as it may have missed invalidations in the meantime
+	assert.Eventually(t, func() bool { return subscribers() == 1 && c.Len() == 0 }, 5*time.Second, 50*time.Millisecond)
+
+	// and then receives invalidations again
+	c.Set(1, "one")
+
+	other := cache.NewInvalidator[int](vp, "test:invalidations")
+	assert.NoError(t, other.Invalidate(context.Background(), 1))
+	assert.Eventually(t, func() bool { return c.Len() == 0 }, time.Second, 10*time.Millisecond)
+}
@@ -2,33 +2,162 @@ package cache
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/jellydator/ttlcache/v3"
+	"github.com/nyaruka/gocommon/dates"
+	"github.com/nyaruka/gocommon/random"
 	"golang.org/x/sync/singleflight"
 )
 
+// ErrNotFound can be returned, or wrapped, by a fetcher when an item doesn't exist, so that the result can be cached
+// if the cache has a not found TTL.
+var ErrNotFound = errors.New("not found")
+
 // Local is a generic in-memory cache with builtin in fetching of missing items.
 type Local[K comparable, V any] struct {
-	cache *ttlcache.Cache[K, V]
+	cache  *ttlcache.Cache[K, *localItem[V]]
+	ttl    time.Duration
+	stale  time.Duration // how long found items are kept after they expire in case they're used stale
+	config *localConfig
 
-	fetch     Fetcher[K, V]
+	fetch     TTLFetcher[K, V]
 	fetchSync singleflight.Group
+
+	batchFetch BatchFetcher[K, V]
+	batchMutex sync.Mutex // guards batchCalls
+	batchCalls map[K]*batchCall[K, V]
+
+	hits        atomic.Int64
+	misses      atomic.Int64
+	fetchErrors atomic.Int64
+	evictions   atomic.Int64
 }
 
 // Fetcher is a function which can fetch an item which doesn't yet exist in the cache.
 type Fetcher[K comparable, V any] func(context.Context, K) (V, error)
 
+// TTLFetcher is a function which can fetch an item which doesn't yet exist in the cache, along with how long to cache
+// it for. A zero TTL means the cache's TTL.
+type TTLFetcher[K comparable, V any] func(context.Context, K) (V, time.Duration, error)
+
+// BatchFetcher is a function which can fetch multiple items which don't yet exist in the cache. Keys missing from the
+// returned map are treated as not found.
+type BatchFetcher[K comparable, V any] func(context.Context, []K) (map[K]V, error)
+
+// batchCall is an in-progress call to a batch fetcher which other callers wanting the same keys can wait on
+type batchCall[K comparable, V any] struct {
+	done chan struct{}
+	vals map[K]V // set before done is closed
+	err  error
+}
+
+// Stats are counts of a cache's activity since it was created
+type Stats struct {
+	Hits        int64 // lookups of items which were in the cache, including stale items being revalidated
+	Misses      int64 // lookups of items which weren't in the cache
+	FetchErrors int64 // fetches which failed, not including items which weren't found
+	Evictions   int64 // items removed to make room for others because the cache was at capacity
+}
+
+// localItem is a value in the cache, or the error from fetching it if it wasn't found
+type localItem[V any] struct {
+	value     V
+	err       error
+	expiresOn time.Time // after which the item is stale
+}
+
+// LocalOption is an option for a local cache
+type LocalOption func(*localConfig)
+
+type localConfig struct {
+	staleWhileRevalidate time.Duration
+	staleOnError         time.Duration
+	notFoundTTL          time.Duration
+	capacity             int
+	ttlJitter            float64
+}
+
+// LocalStaleWhileRevalidate makes a cache return an expired item for up to the given duration after it expired,
+// while fetching a new value in the background.
+func LocalStaleWhileRevalidate(d time.Duration) LocalOption {
+	return func(c *localConfig) { c.staleWhileRevalidate = d }
+}
+
+// LocalStaleOnError makes a cache return an expired item for up to the given duration after it expired if fetching
+// a new value fails.
+func LocalStaleOnError(maxStale time.Duration) LocalOption {
+	return func(c *localConfig) { c.staleOnError = maxStale }
+}
+
+// LocalNotFoundTTL makes a cache remember items which the fetcher reported as not existing, by returning an error
+// which is or wraps ErrNotFound, for the given TTL, which is typically shorter than that for found items.
+func LocalNotFoundTTL(ttl time.Duration) LocalOption {
+	return func(c *localConfig) { c.notFoundTTL = ttl }
+}
+
+// LocalCapacity limits a cache to the given number of items, evicting the least recently used item to make room
+// for a new one when it's full.
+func LocalCapacity(n int) LocalOption {
+	return func(c *localConfig) { c.capacity = n }
+}
+
+// LocalTTLJitter makes a cache randomly vary the TTL of each item by up to the given fraction of it, e.g. 0.1 for
+// +/-10%, so that items cached at the same time don't all expire at the same time. The fraction is clamped to between
+// 0 and 1.
+func LocalTTLJitter(fraction float64) LocalOption {
+	return func(c *localConfig) { c.ttlJitter = min(max(fraction, 0), 1) }
+}
+
 // NewLocal creates a new in-memory cache.
-func NewLocal[K comparable, V any](fetch Fetcher[K, V], ttl time.Duration) *Local[K, V] {
-	return &Local[K, V]{
-		cache: ttlcache.New[K, V](
-			ttlcache.WithTTL[K, V](ttl),
-			ttlcache.WithDisableTouchOnHit[K, V](),
-		),
-		fetch: fetch,
+func NewLocal[K comparable, V any](fetch Fetcher[K, V], ttl time.Duration, opts ...LocalOption) *Local[K, V] {
+	return NewLocalWithTTLFetcher(func(ctx context.Context, key K) (V, time.Duration, error) {
+		val, err := fetch(ctx, key)
+		return val, 0, err
+	}, ttl, opts...)
+}
+
+// NewLocalWithTTLFetcher creates a new in-memory cache whose fetcher decides how long to cache each item for.
+func NewLocalWithTTLFetcher[K comparable, V any](fetch TTLFetcher[K, V], ttl time.Duration, opts ...LocalOption) *Local[K, V] {
+	config := &localConfig{}
+	for _, opt := range opts {
+		opt(config)
+	}
+
+	cacheOpts := []ttlcache.Option[K, *localItem[V]]{ttlcache.WithDisableTouchOnHit[K, *localItem[V]]()}
+	if config.capacity > 0 {
+		cacheOpts = append(cacheOpts, ttlcache.WithCapacity[K, *localItem[V]](uint64(config.capacity)))
 	}
+
+	c := &Local[K, V]{
+		cache:      ttlcache.New(cacheOpts...),
+		ttl:        ttl,
+		stale:      max(config.staleWhileRevalidate, config.staleOnError),
+		config:     config,
+		fetch:      fetch,
+		batchCalls: make(map[K]*batchCall[K, V]),
+	}
+
+	c.cache.OnEviction(func(ctx context.Context, reason ttlcache.EvictionReason, item *ttlcache.Item[K, *localItem[V]]) {
+		if reason == ttlcache.EvictionReasonCapacityReached {
+			c.evictions.Add(1)
+		}
+	})
+
+	return c
+}
+
+// NewLocalWithBatchFetcher creates a new in-memory cache which also has a batch fetcher for fetching the missing items
+// in calls to GetOrFetchMany. Items fetched by the batch fetcher are cached for the cache's TTL.
+func NewLocalWithBatchFetcher[K comparable, V any](fetch Fetcher[K, V], fetchMany BatchFetcher[K, V], ttl time.Duration, opts ...LocalOption) *Local[K, V] {
+	c := NewLocal(fetch, ttl, opts...)
+	c.batchFetch = fetchMany
+	return c
 }
 
 // Start starts the routine to eliminate expired items from the cache.
@@ -41,43 +170,137 @@ func (c *Local[K, V]) Stop() {
 	c.cache.Stop()
 }
 
-// Len returns the number of items in the cache.
+// Len returns the number of items in the cache, including stale items and items which weren't found.
 func (c *Local[K, V]) Len() int {
 	return c.cache.Len()
 }
 
+// Stats returns counts of this cache's activity.
+func (c *Local[K, V]) Stats() Stats {
+	return Stats{
+		Hits:        c.hits.Load(),
+		Misses:      c.misses.Load(),
+		FetchErrors: c.fetchErrors.Load(),
+		Evictions:   c.evictions.Load(),
+	}
+}
+
 // Get returns the item with the given key from the cache or the type's zero value.
 func (c *Local[K, V]) Get(key K) V {
 	item := c.cache.Get(key)
 
-	if item != nil {
-		return item.Value()
+	if item != nil && item.Value().fresh() {
+		c.hits.Add(1)
+		return item.Value().value
 	}
 
+	c.misses.Add(1)
+
 	var zero V
 	return zero
 }
 
 // GetOrFetch looks for the item in cache and if not found tries to fetch it.
 func (c *Local[K, V]) GetOrFetch(ctx context.Context, key K) (V, error) {
-	item := c.cache.Get(key)
+	var zero V
+	var stale *localItem[V]
 
-	if item == nil {
-		var err error
+	if item := c.cache.Get(key); item != nil {
+		li := item.Value()
+		if li.fresh() {
+			c.hits.Add(1)
+			return li.value, li.err
+		}
 
-		item, err = c.fetchAndSetSynced(ctx, key)
-		if err != nil {
-			var zero V
-			return zero, err
+		if li.err == nil {
+			stale = li
+
+			if c.config.staleWhileRevalidate > 0 && dates.Since(li.expiresOn) <= c.config.staleWhileRevalidate {
+				c.hits.Add(1)
+				go c.revalidate(context.WithoutCancel(ctx), key)
+				return li.value, nil
+			}
+		}
+	}
+
+	c.misses.Add(1)
+
+	li, err := c.fetchAndSetSynced(ctx, key)
+	if err != nil {
+		if stale != nil && !errors.Is(err, ErrNotFound) && c.config.staleOnError > 0 && dates.Since(stale.expiresOn) <= c.config.staleOnError {
+			return stale.value, nil
+		}
+		return zero, err
+	}
+
+	return li.value, li.err
+}
+
+// GetOrFetchMany looks for the items in cache and fetches any which aren't found, in a single call to the batch
+// fetcher if the cache has one, or else one at a time. Concurrent calls which need some of the same items wait for
+// each other's fetches of those items rather than fetching them again. Stale items are used as they are by GetOrFetch,
+// and items which don't exist are omitted from the returned map.
+func (c *Local[K, V]) GetOrFetchMany(ctx context.Context, keys []K) (map[K]V, error) {
+	vals := make(map[K]V, len(keys))
+	stale := make(map[K]*localItem[V])
+	var missing, revalidate []K
+
+	for _, key := range keys {
+		if item := c.cache.Get(key); item != nil {
+			li := item.Value()
+			if li.fresh() {
+				c.hits.Add(1)
+				if li.err == nil {
+					vals[key] = li.value
+				}
+				continue
+			}
+
+			if li.err == nil {
+				stale[key] = li
+
+				if c.config.staleWhileRevalidate > 0 && dates.Since(li.expiresOn) <= c.config.staleWhileRevalidate {
+					c.hits.Add(1)
+					vals[key] = li.value
+					revalidate = append(revalidate, key)
+					continue
+				}
+			}
+		}
+
+		c.misses.Add(1)
+		missing = append(missing, key)
+	}
+
+	if len(revalidate) > 0 {
+		go c.revalidateMany(context.WithoutCancel(ctx), revalidate)
+	}
+
+	for key, err := range c.fetchMany(ctx, missing, vals) {
+		if li := stale[key]; li != nil && c.config.staleOnError > 0 && dates.Since(li.expiresOn) <= c.config.staleOnError {
+			vals[key] = li.value
+		} else {
+			return nil, err
 		}
 	}
 
-	return item.Value(), nil
+	return vals, nil
 }
 
 // Set overwrites the value for the given key.
 func (c *Local[K, V]) Set(key K, val V) {
-	c.cache.Set(key, val, ttlcache.DefaultTTL)
+	c.set(key, val, nil, c.ttl)
+}
+
+// SetWithTTL overwrites the value for the given key, caching it for the given TTL rather than the cache's TTL. As for
+// a TTLFetcher, a zero TTL means the cache's TTL.
+func (c *Local[K, V]) SetWithTTL(key K, val V, ttl time.Duration) {
+	c.set(key, val, nil, ttl)
+}
+
+// Delete removes the item with the given key from the cache.
+func (c *Local[K, V]) Delete(key K) {
+	c.cache.Delete(key)
 }
 
 // Clear removes all items from the cache.
@@ -85,7 +308,19 @@ func (c *Local[K, V]) Clear() {
 	c.cache.DeleteAll()
 }
 
-func (c *Local[K, V]) fetchAndSetSynced(ctx context.Context, key K) (*ttlcache.Item[K, V], error) {
+func (c *Local[K, V]) revalidate(ctx context.Context, key K) {
+	if _, err := c.fetchAndSetSynced(ctx, key); err != nil && !errors.Is(err, ErrNotFound) {
+		slog.Error("error revalidating cached item", "key", key, "error", err)
+	}
+}
+
+func (c *Local[K, V]) revalidateMany(ctx context.Context, keys []K) {
+	for key, err := range c.fetchMany(ctx, keys, make(map[K]V, len(keys))) {
+		slog.Error("error revalidating cached item", "key", key, "error", err)
+	}
+}
+
+func (c *Local[K, V]) fetchAndSetSynced(ctx context.Context, key K) (*localItem[V], error) {
 	// singleflight isn't generic and requires string keys but probably not many comparable types
 	// that don't string stringify predictably
 	keyStr := fmt.Sprint(key)
@@ -94,8 +329,8 @@ func (c *Local[K, V]) fetchAndSetSynced(ctx context.Context, key K) (*ttlcache.I
 		// there's always a chance a different thread completed a fetch before we got here
 		// so check again now that we have a lock for the key
 		item := c.cache.Get(key)
-		if item != nil {
-			return item, nil
+		if item != nil && item.Value().fresh() {
+			return item.Value(), nil
 		}
 
 		return c.fetchAndSet(ctx, key)
@@ -104,14 +339,164 @@ func (c *Local[K, V]) fetchAndSetSynced(ctx context.Context, key K) (*ttlcache.I
 	if err != nil {
 		return nil, err
 	}
-	return ii.(*ttlcache.Item[K, V]), nil
+	return ii.(*localItem[V]), nil
 }
 
-func (c *Local[K, V]) fetchAndSet(ctx context.Context, key K) (*ttlcache.Item[K, V], error) {
-	val, err := c.fetch(ctx, key)
+func (c *Local[K, V]) fetchAndSet(ctx context.Context, key K) (*localItem[V], error) {
+	val, ttl, err := c.fetch(ctx, key)
 	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			if c.config.notFoundTTL > 0 {
+				var zero V
+				return c.set(key, zero, err, c.config.notFoundTTL), nil
+			}
+		} else {
+			c.fetchErrors.Add(1)
+		}
 		return nil, err
 	}
 
-	return c.cache.Set(key, val, ttlcache.DefaultTTL), nil
+	return c.set(key, val, nil, ttl), nil
+}
+
+// getFresh adds the item with the given key to vals if it's fresh, returning whether it was, even if not found
+func (c *Local[K, V]) getFresh(key K, vals map[K]V) bool {
+	item := c.cache.Get(key)
+	if item == nil || !item.Value().fresh() {
+		return false
+	}
+	if item.Value().err == nil {
+		vals[key] = item.Value().value
+	}
+	return true
+}
+
+// fetchMany fetches the given items, adding those found to vals and returning the errors for any which couldn't be
+// fetched, not including those which don't exist
+func (c *Local[K, V]) fetchMany(ctx context.Context, keys []K, vals map[K]V) map[K]error {
+	errs := make(map[K]error)
+
+	if c.batchFetch == nil {
+		for _, key := range keys {
+			li, err := c.fetchAndSetSynced(ctx, key)
+			if err != nil {
+				if !errors.Is(err, ErrNotFound) {
+					errs[key] = err
+				}
+			} else if li.err == nil {
+				vals[key] = li.value
+			}
+		}
+		return errs
+	}
+
+	// work out which calls will provide each item, adding those not already being fetched to our own call
+	own := &batchCall[K, V]{done: make(chan struct{})}
+	calls := make(map[K]*batchCall[K, V], len(keys))
+	var toFetch []K
+
+	c.batchMutex.Lock()
+	for _, key := range keys {
+		if _, seen := calls[key]; seen {
+			continue
+		}
+
+		// an item might have been fetched by a call that completed since we checked
+		if c.getFresh(key, vals) {
+			continue
+		}
+
+		call := c.batchCalls[key]
+		if call == nil {
+			call = own
+			c.batchCalls[key] = own
+			toFetch = append(toFetch, key)
+		}
+		calls[key] = call
+	}
+	c.batchMutex.Unlock()
+
+	if len(toFetch) > 0 {
+		c.fetchBatch(ctx, own, toFetch)
+	}
+
+	for key, call := range calls {
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			errs[key] = ctx.Err()
+			continue
+		}
+
+		if call.err != nil {
+			errs[key] = call.err
+		} else if v, ok := call.vals[key]; ok {
+			vals[key] = v
+		}
+	}
+
+	return errs
+}
+
+// fetchBatch fetches the given items for a batch call, caching them before completing the call
+func (c *Local[K, V]) fetchBatch(ctx context.Context, call *batchCall[K, V], keys []K) {
+	defer func() {
+		c.batchMutex.Lock()
+		for _, key := range keys {
+			delete(c.batchCalls, key)
+		}
+		c.batchMutex.Unlock()
+
+		close(call.done)
+	}()
+
+	fetched, err := c.batchFetch(ctx, keys)
+	if err != nil {
+		c.fetchErrors.Add(1)
+		call.err = err
+		return
+	}
+
+	call.vals = fetched
+
+	for _, key := range keys {
+		if val, ok := fetched[key]; ok {
+			c.set(key, val, nil, c.ttl)
+		} else if c.config.notFoundTTL > 0 {
+			var zero V
+			c.set(key, zero, ErrNotFound, c.config.notFoundTTL)
+		}
+	}
+}
+
+// set caches a value, or the error from fetching it if it wasn't found, for the given TTL plus any jitter. A zero
+// TTL means the cache's TTL, and if that's also zero then the item never expires.
+func (c *Local[K, V]) set(key K, val V, err error, ttl time.Duration) *localItem[V] {
+	li := &localItem[V]{value: val, err: err}
+	keepFor := ttlcache.NoTTL
+
+	if ttl <= 0 {
+		ttl = c.ttl
+	}
+
+	if ttl > 0 {
+		if c.config.ttlJitter > 0 {
+			ttl = max(ttl+time.Duration((random.Float64()*2-1)*c.config.ttlJitter*float64(ttl)), 1)
+		}
+
+		li.expiresOn = dates.Now().Add(ttl)
+		keepFor = ttl
+
+		// found items are kept for as long as they might be used stale
+		if err == nil {
+			keepFor += c.stale
+		}
+	}
+
+	c.cache.Set(key, li, keepFor)
+	return li
+}
+
+func (li *localItem[V]) fresh() bool {
+	return li.expiresOn.IsZero() || dates.Now().Before(li.expiresOn)
 }
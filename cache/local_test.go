@@ -4,12 +4,16 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/nyaruka/gocommon/cache"
+	"github.com/nyaruka/gocommon/dates"
+	"github.com/nyaruka/gocommon/random"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -126,9 +130,414 @@ func TestLocal(t *testing.T) {
 	cache.Set("x", "234")
 	assert.Equal(t, 2, cache.Len())
 
+	cache.Delete("a")
+	assert.Equal(t, 1, cache.Len())
+	assert.Equal(t, "", cache.Get("a"))
+
 	cache.Clear()
 
 	assert.Equal(t, 0, cache.Len())
 
 	cache.Stop()
 }
+
+func TestLocalStale(t *testing.T) {
+	ctx := context.Background()
+
+	var fetchCount atomic.Int32
+	var fetchErr error
+	fetchErrMutex := &sync.Mutex{}
+	setFetchErr := func(err error) {
+		fetchErrMutex.Lock()
+		fetchErr = err
+		fetchErrMutex.Unlock()
+	}
+
+	fetch := func(ctx context.Context, k string) (string, error) {
+		fc := fetchCount.Add(1)
+
+		fetchErrMutex.Lock()
+		defer fetchErrMutex.Unlock()
+		if fetchErr != nil {
+			return "", fetchErr
+		}
+		return fmt.Sprintf("%s/%d", strings.ToUpper(k), fc), nil
+	}
+
+	// stale while revalidate returns the stale value and refreshes it in the background
+	c := cache.NewLocal(fetch, 100*time.Millisecond, cache.LocalStaleWhileRevalidate(time.Second))
+
+	v, err := c.GetOrFetch(ctx, "x")
+	assert.NoError(t, err)
+	assert.Equal(t, "X/1", v)
+
+	time.Sleep(150 * time.Millisecond)
+
+	assert.Equal(t, "", c.Get("x")) // only fresh items are returned by Get
+
+	v, err = c.GetOrFetch(ctx, "x")
+	assert.NoError(t, err)
+	assert.Equal(t, "X/1", v)
+
+	assert.Eventually(t, func() bool { return c.Get("x") == "X/2" }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, int32(2), fetchCount.Load())
+
+	// but not beyond the stale while revalidate window
+	time.Sleep(1200 * time.Millisecond)
+
+	v, err = c.GetOrFetch(ctx, "x")
+	assert.NoError(t, err)
+	assert.Equal(t, "X/3", v)
+
+	// stale on error returns the stale value if fetching fails
+	fetchCount.Store(0)
+	c = cache.NewLocal(fetch, 100*time.Millisecond, cache.LocalStaleOnError(200*time.Millisecond))
+
+	v, err = c.GetOrFetch(ctx, "x")
+	assert.NoError(t, err)
+	assert.Equal(t, "X/1", v)
+
+	time.Sleep(150 * time.Millisecond)
+	setFetchErr(errors.New("boom"))
+
+	v, err = c.GetOrFetch(ctx, "x")
+	assert.NoError(t, err)
+	assert.Equal(t, "X/1", v)
+	assert.Equal(t, int32(2), fetchCount.Load())
+
+	// but not beyond the max staleness
+	time.Sleep(200 * time.Millisecond)
+
+	_, err = c.GetOrFetch(ctx, "x")
+	assert.EqualError(t, err, "boom")
+
+	// or if the item no longer exists
+	c.Set("y", "Y/X")
+	time.Sleep(150 * time.Millisecond)
+	setFetchErr(fmt.Errorf("no such thing: %w", cache.ErrNotFound))
+
+	_, err = c.GetOrFetch(ctx, "y")
+	assert.ErrorIs(t, err, cache.ErrNotFound)
+}
+
+func TestLocalStaleBoundary(t *testing.T) {
+	ctx := context.Background()
+
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	defer dates.SetNowFunc(time.Now)
+	dates.SetNowFunc(func() time.Time { return now })
+
+	var fetchCount atomic.Int32
+	fetch := func(ctx context.Context, k string) (string, error) {
+		if fetchCount.Add(1) > 2 {
+			return "", errors.New("boom")
+		}
+		return strings.ToUpper(k), nil
+	}
+
+	// without stale options, an item which has only just expired isn't used when refetching it fails
+	c := cache.NewLocal(fetch, time.Minute)
+
+	v, err := c.GetOrFetch(ctx, "a")
+	assert.NoError(t, err)
+	assert.Equal(t, "A", v)
+	vals, err := c.GetOrFetchMany(ctx, []string{"b"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"b": "B"}, vals)
+
+	now = now.Add(time.Minute)
+
+	_, err = c.GetOrFetch(ctx, "a")
+	assert.EqualError(t, err, "boom")
+	_, err = c.GetOrFetchMany(ctx, []string{"b"})
+	assert.EqualError(t, err, "boom")
+	assert.Equal(t, int32(4), fetchCount.Load())
+}
+
+func TestLocalNotFound(t *testing.T) {
+	ctx := context.Background()
+
+	fetchCounts := make(map[string]int)
+	fetch := func(ctx context.Context, k string) (string, error) {
+		fetchCounts[k]++
+		if k == "missing" {
+			return "", fmt.Errorf("no such thing: %w", cache.ErrNotFound)
+		} else if k == "error" {
+			return "", errors.New("boom")
+		}
+		return strings.ToUpper(k), nil
+	}
+
+	c := cache.NewLocal(fetch, time.Second, cache.LocalNotFoundTTL(100*time.Millisecond))
+
+	for range 3 {
+		_, err := c.GetOrFetch(ctx, "missing")
+		assert.EqualError(t, err, "no such thing: not found")
+		assert.ErrorIs(t, err, cache.ErrNotFound)
+	}
+	assert.Equal(t, 1, fetchCounts["missing"])
+	assert.Equal(t, "", c.Get("missing"))
+
+	// other errors aren't cached
+	for range 3 {
+		_, err := c.GetOrFetch(ctx, "error")
+		assert.EqualError(t, err, "boom")
+	}
+	assert.Equal(t, 3, fetchCounts["error"])
+
+	// not found results expire after their shorter TTL
+	time.Sleep(150 * time.Millisecond)
+
+	_, err := c.GetOrFetch(ctx, "missing")
+	assert.ErrorIs(t, err, cache.ErrNotFound)
+	assert.Equal(t, 2, fetchCounts["missing"])
+
+	// and without a not found TTL, they aren't cached at all
+	c = cache.NewLocal(fetch, time.Second)
+
+	for range 2 {
+		_, err := c.GetOrFetch(ctx, "missing")
+		assert.ErrorIs(t, err, cache.ErrNotFound)
+	}
+	assert.Equal(t, 4, fetchCounts["missing"])
+}
+
+func TestLocalGetOrFetchMany(t *testing.T) {
+	ctx := context.Background()
+
+	var fetchCalls [][]string
+	fetchCallsMutex := &sync.Mutex{}
+
+	fetch := func(ctx context.Context, k string) (string, error) { return strings.ToUpper(k), nil }
+	fetchMany := func(ctx context.Context, ks []string) (map[string]string, error) {
+		fetchCallsMutex.Lock()
+		fetchCalls = append(fetchCalls, slices.Sorted(slices.Values(ks)))
+		fetchCallsMutex.Unlock()
+
+		vals := make(map[string]string, len(ks))
+		for _, k := range ks {
+			switch k {
+			case "error":
+				return nil, errors.New("boom")
+			case "missing":
+				continue
+			case "slow":
+				time.Sleep(200 * time.Millisecond)
+			}
+			vals[k] = strings.ToUpper(k)
+		}
+		return vals, nil
+	}
+
+	c := cache.NewLocalWithBatchFetcher(fetch, fetchMany, time.Second, cache.LocalNotFoundTTL(time.Second))
+
+	vals, err := c.GetOrFetchMany(ctx, []string{"a", "b", "a"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"a": "A", "b": "B"}, vals)
+	assert.Equal(t, [][]string{{"a", "b"}}, fetchCalls)
+
+	// only missing items are fetched, and those which don't exist are omitted
+	vals, err = c.GetOrFetchMany(ctx, []string{"a", "b", "c", "missing"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"a": "A", "b": "B", "c": "C"}, vals)
+	assert.Equal(t, [][]string{{"a", "b"}, {"c", "missing"}}, fetchCalls)
+
+	// not found items are remembered too
+	vals, err = c.GetOrFetchMany(ctx, []string{"c", "missing"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"c": "C"}, vals)
+	assert.Len(t, fetchCalls, 2)
+
+	// items fetched in a batch can be got individually
+	assert.Equal(t, "C", c.Get("c"))
+	_, err = c.GetOrFetch(ctx, "missing")
+	assert.ErrorIs(t, err, cache.ErrNotFound)
+
+	// errors fail the whole call and aren't cached
+	_, err = c.GetOrFetchMany(ctx, []string{"d", "error"})
+	assert.EqualError(t, err, "boom")
+	assert.Equal(t, "", c.Get("d"))
+
+	// concurrent calls for overlapping items wait for each other
+	fetchCalls = nil
+	wg := &sync.WaitGroup{}
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		vals, err := c.GetOrFetchMany(ctx, []string{"slow", "e"})
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]string{"slow": "SLOW", "e": "E"}, vals)
+	}()
+	go func() {
+		defer wg.Done()
+		time.Sleep(50 * time.Millisecond)
+		vals, err := c.GetOrFetchMany(ctx, []string{"slow", "f"})
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]string{"slow": "SLOW", "f": "F"}, vals)
+	}()
+
+	wg.Wait()
+	assert.Equal(t, [][]string{{"e", "slow"}, {"f"}}, fetchCalls)
+
+	// without a batch fetcher, missing items are fetched individually
+	c = cache.NewLocal(fetch, time.Second)
+
+	vals, err = c.GetOrFetchMany(ctx, []string{"x", "y"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"x": "X", "y": "Y"}, vals)
+	assert.Equal(t, 2, c.Len())
+
+	// stale items are used as they are by GetOrFetch
+	var version atomic.Int32
+	var failing atomic.Bool
+	fetchVersions := func(ctx context.Context, ks []string) (map[string]string, error) {
+		if failing.Load() {
+			return nil, errors.New("boom")
+		}
+		v := version.Add(1)
+		vals := make(map[string]string, len(ks))
+		for _, k := range ks {
+			vals[k] = fmt.Sprintf("%s/%d", strings.ToUpper(k), v)
+		}
+		return vals, nil
+	}
+
+	c = cache.NewLocalWithBatchFetcher(fetch, fetchVersions, 200*time.Millisecond, cache.LocalStaleWhileRevalidate(time.Second))
+
+	vals, err = c.GetOrFetchMany(ctx, []string{"a", "b"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"a": "A/1", "b": "B/1"}, vals)
+
+	time.Sleep(250 * time.Millisecond)
+
+	// stale items are returned while they're revalidated in the background, in a single batch
+	vals, err = c.GetOrFetchMany(ctx, []string{"a", "b"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"a": "A/1", "b": "B/1"}, vals)
+
+	assert.Eventually(t, func() bool { return c.Get("a") == "A/2" && c.Get("b") == "B/2" }, time.Second, 10*time.Millisecond)
+
+	c = cache.NewLocalWithBatchFetcher(fetch, fetchVersions, 100*time.Millisecond, cache.LocalStaleOnError(time.Second))
+
+	vals, err = c.GetOrFetchMany(ctx, []string{"a"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"a": "A/3"}, vals)
+
+	failing.Store(true)
+	time.Sleep(150 * time.Millisecond)
+
+	// stale items are returned if fetching fails, but that's still an error for items which aren't cached at all
+	vals, err = c.GetOrFetchMany(ctx, []string{"a"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"a": "A/3"}, vals)
+
+	_, err = c.GetOrFetchMany(ctx, []string{"a", "b"})
+	assert.EqualError(t, err, "boom")
+}
+
+func TestLocalCapacityAndTTLs(t *testing.T) {
+	ctx := context.Background()
+
+	fetch := func(ctx context.Context, k string) (string, time.Duration, error) {
+		switch k {
+		case "error":
+			return "", 0, errors.New("boom")
+		case "missing":
+			return "", 0, cache.ErrNotFound
+		case "short":
+			return "SHORT", 100 * time.Millisecond, nil
+		}
+		return strings.ToUpper(k), 0, nil
+	}
+
+	c := cache.NewLocalWithTTLFetcher(fetch, time.Minute, cache.LocalCapacity(3))
+
+	for _, k := range []string{"a", "b", "c"} {
+		_, err := c.GetOrFetch(ctx, k)
+		assert.NoError(t, err)
+	}
+
+	// using a makes b the least recently used item, so it's evicted to make room for d
+	assert.Equal(t, "A", c.Get("a"))
+
+	_, err := c.GetOrFetch(ctx, "d")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, c.Len())
+	assert.Equal(t, "", c.Get("b"))
+	assert.Equal(t, "C", c.Get("c"))
+
+	_, err = c.GetOrFetch(ctx, "error")
+	assert.EqualError(t, err, "boom")
+	_, err = c.GetOrFetch(ctx, "missing")
+	assert.ErrorIs(t, err, cache.ErrNotFound)
+
+	// evictions are counted asynchronously
+	assert.Eventually(t, func() bool { return c.Stats().Evictions == 1 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, cache.Stats{Hits: 2, Misses: 7, FetchErrors: 1, Evictions: 1}, c.Stats())
+
+	// fetcher can give items their own TTL
+	c = cache.NewLocalWithTTLFetcher(fetch, time.Minute)
+
+	v, err := c.GetOrFetch(ctx, "short")
+	assert.NoError(t, err)
+	assert.Equal(t, "SHORT", v)
+	_, err = c.GetOrFetch(ctx, "long")
+	assert.NoError(t, err)
+
+	// as can setting them, where a zero TTL means the cache's TTL as it does for the fetcher
+	c.SetWithTTL("x", "X", 100*time.Millisecond)
+	c.SetWithTTL("y", "Y", 0)
+
+	time.Sleep(150 * time.Millisecond)
+
+	assert.Equal(t, "", c.Get("short"))
+	assert.Equal(t, "LONG", c.Get("long"))
+	assert.Equal(t, "", c.Get("x"))
+	assert.Equal(t, "Y", c.Get("y"))
+
+	// jitter varies when items expire, which we can check deterministically with a fixed clock and seeded generator
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	defer dates.SetNowFunc(time.Now)
+	dates.SetNowFunc(func() time.Time { return now })
+
+	defer random.SetGenerator(random.DefaultGenerator)
+	random.SetGenerator(random.NewSeededGenerator(123456))
+
+	jittered := cache.NewLocal(func(ctx context.Context, k int) (int, error) { return k, nil }, 10*time.Second, cache.LocalTTLJitter(0.5))
+
+	for i := range 20 {
+		jittered.Set(i, i+1)
+	}
+
+	countFresh := func() int {
+		n := 0
+		for i := range 20 {
+			if jittered.Get(i) == i+1 {
+				n++
+			}
+		}
+		return n
+	}
+
+	now = now.Add(4 * time.Second)
+	assert.Equal(t, 20, countFresh())
+
+	now = now.Add(6 * time.Second)
+	assert.Equal(t, 14, countFresh())
+
+	now = now.Add(6 * time.Second)
+	assert.Equal(t, 0, countFresh())
+
+	// a fraction above 1 is clamped so that TTLs are never negative
+	jittered = cache.NewLocal(func(ctx context.Context, k int) (int, error) { return k, nil }, 10*time.Second, cache.LocalTTLJitter(5))
+
+	for i := range 20 {
+		jittered.Set(i, i+1)
+	}
+
+	assert.Equal(t, 20, countFresh())
+
+	now = now.Add(20 * time.Second)
+	assert.Equal(t, 0, countFresh())
+}
@@ -0,0 +1,302 @@
+package cache
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	valkey "github.com/gomodule/redigo/redis"
+)
+
+const (
+	tieredLockTTL  = 10 * time.Second      // how long a process can hold the lock for fetching an item
+	tieredLockPoll = 50 * time.Millisecond // how often processes waiting on that lock check for the item or the lock
+)
+
+// Codec encodes and decodes values so that they can be stored in valkey.
+type Codec[V any] interface {
+	Encode(V) ([]byte, error)
+	Decode([]byte) (V, error)
+}
+
+// JSONCodec is a codec which stores values as JSON.
+type JSONCodec[V any] struct{}
+
+func (JSONCodec[V]) Encode(v V) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONCodec[V]) Decode(b []byte) (V, error) {
+	var v V
+	err := json.Unmarshal(b, &v)
+	return v, err
+}
+
+// Tiered is a generic two-tier cache which keeps items in memory, backed by valkey so that items fetched by one
+// process can be used by others, with builtin fetching of items missing from both.
+//
+// Fetching is protected at both tiers: within a process only one caller looks up a missing item, and across
+// processes only the one holding a short-lived lock in valkey fetches it, while the others wait for it to appear.
+type Tiered[K comparable, V any] struct {
+	local *Local[K, V]
+
+	vp        *valkey.Pool
+	keyPrefix string
+	ttl       time.Duration
+	codec     Codec[V]
+	fetch     Fetcher[K, V]
+}
+
+// NewTiered creates a new two-tier cache. Items are kept in memory for localTTL and in valkey, under keys with the
+// given prefix, for remoteTTL, or without expiring if that's zero. The keys of items in valkey are tracked in a set
+// at <keyPrefix>:keys, so that the cache can be cleared without touching other keys. The prefix can't be empty. If
+// codec is nil then values are stored as JSON.
+func NewTiered[K comparable, V any](fetch Fetcher[K, V], vp *valkey.Pool, keyPrefix string, localTTL, remoteTTL time.Duration, codec Codec[V]) *Tiered[K, V] {
+	if keyPrefix == "" {
+		panic("tiered cache key prefix can't be empty")
+	}
+	if codec == nil {
+		codec = JSONCodec[V]{}
+	}
+
+	t := &Tiered[K, V]{vp: vp, keyPrefix: keyPrefix, ttl: remoteTTL, codec: codec, fetch: fetch}
+	t.local = NewLocal(t.fetchRemote, localTTL)
+	return t
+}
+
+// Start starts the routine to eliminate expired items from the local cache.
+func (t *Tiered[K, V]) Start() {
+	t.local.Start()
+}
+
+// Stop stops that routine.
+func (t *Tiered[K, V]) Stop() {
+	t.local.Stop()
+}
+
+// Len returns the number of items in the local cache.
+func (t *Tiered[K, V]) Len() int {
+	return t.local.Len()
+}
+
+// GetOrFetch looks for the item in the local cache, then in valkey, and if not found in either tries to fetch it.
+func (t *Tiered[K, V]) GetOrFetch(ctx context.Context, key K) (V, error) {
+	return t.local.GetOrFetch(ctx, key)
+}
+
+// Set overwrites the value for the given key in both tiers.
+func (t *Tiered[K, V]) Set(ctx context.Context, key K, val V) error {
+	if err := t.setRemote(ctx, t.remoteKey(key), val); err != nil {
+		return err
+	}
+
+	t.local.Set(key, val)
+	return nil
+}
+
+// Delete removes the item with the given key from the local cache. Use an Invalidator to remove it from valkey and the
+// local caches of other processes.
+func (t *Tiered[K, V]) Delete(key K) {
+	t.local.Delete(key)
+}
+
+// Clear removes all items from the local cache. Use an Invalidator to remove them from valkey and the local caches of
+// other processes.
+func (t *Tiered[K, V]) Clear() {
+	t.local.Clear()
+}
+
+// fetchRemote is the fetcher for the local cache, so calls to it are already synced by key within this process. Errors
+// from valkey are logged rather than returned, as we can still fetch the item, we just can't share it with others.
+func (t *Tiered[K, V]) fetchRemote(ctx context.Context, key K) (V, error) {
+	var zero V
+	vkey := t.remoteKey(key)
+
+	for {
+		val, found, err := t.getRemote(ctx, vkey)
+		if err != nil {
+			slog.Error("error getting cached item from valkey", "key", vkey, "error", err)
+			break
+		}
+		if found {
+			return val, nil
+		}
+
+		token, locked, err := t.lock(ctx, vkey)
+		if err != nil {
+			slog.Error("error acquiring fetch lock in valkey", "key", vkey, "error", err)
+			break
+		}
+		if locked {
+			defer t.unlock(context.WithoutCancel(ctx), vkey, token)
+			break
+		}
+
+		// another process is fetching this item so wait for it to appear, or for that process to release the lock
+		// without it, e.g. because its fetch failed or it died, in which case we'll take the lock and fetch it
+		select {
+		case <-ctx.Done():
+			return zero, ctx.Err()
+		case <-time.After(tieredLockPoll):
+		}
+	}
+
+	val, err := t.fetch(ctx, key)
+	if err != nil {
+		return zero, err
+	}
+
+	if err := t.setRemote(ctx, vkey, val); err != nil {
+		slog.Error("error setting cached item in valkey", "key", vkey, "error", err)
+	}
+
+	return val, nil
+}
+
+// deleteShared removes the item with the given key from valkey
+func (t *Tiered[K, V]) deleteShared(ctx context.Context, key K) error {
+	vc, err := t.vp.GetContext(ctx)
+	if err != nil {
+		return fmt.Errorf("error getting valkey connection: %w", err)
+	}
+	defer vc.Close()
+
+	vkey := t.remoteKey(key)
+
+	if _, err := valkey.DoContext(vc, ctx, "DEL", vkey); err != nil {
+		return fmt.Errorf("error deleting cached item: %w", err)
+	}
+	if _, err := valkey.DoContext(vc, ctx, "SREM", t.keysKey(), vkey); err != nil {
+		return fmt.Errorf("error untracking cached item: %w", err)
+	}
+	return nil
+}
+
+// clearShared removes all items from valkey, popping their keys from the set of tracked keys in batches so that items
+// added while we're clearing are either removed too or stay tracked
+func (t *Tiered[K, V]) clearShared(ctx context.Context) error {
+	vc, err := t.vp.GetContext(ctx)
+	if err != nil {
+		return fmt.Errorf("error getting valkey connection: %w", err)
+	}
+	defer vc.Close()
+
+	for {
+		keys, err := valkey.Values(valkey.DoContext(vc, ctx, "SPOP", t.keysKey(), 1000))
+		if err != nil {
+			return fmt.Errorf("error popping cached item keys: %w", err)
+		}
+		if len(keys) == 0 {
+			return nil
+		}
+
+		if _, err := valkey.DoContext(vc, ctx, "DEL", keys...); err != nil {
+			return fmt.Errorf("error deleting cached items: %w", err)
+		}
+	}
+}
+
+func (t *Tiered[K, V]) getRemote(ctx context.Context, vkey string) (V, bool, error) {
+	var zero V
+
+	vc, err := t.vp.GetContext(ctx)
+	if err != nil {
+		return zero, false, fmt.Errorf("error getting valkey connection: %w", err)
+	}
+	defer vc.Close()
+
+	data, err := valkey.Bytes(valkey.DoContext(vc, ctx, "GET", vkey))
+	if err == valkey.ErrNil {
+		return zero, false, nil
+	}
+	if err != nil {
+		return zero, false, fmt.Errorf("error getting cached item: %w", err)
+	}
+
+	val, err := t.codec.Decode(data)
+	if err != nil {
+		return zero, false, fmt.Errorf("error decoding cached item: %w", err)
+	}
+	return val, true, nil
+}
+
+func (t *Tiered[K, V]) setRemote(ctx context.Context, vkey string, val V) error {
+	data, err := t.codec.Encode(val)
+	if err != nil {
+		return fmt.Errorf("error encoding item: %w", err)
+	}
+
+	vc, err := t.vp.GetContext(ctx)
+	if err != nil {
+		return fmt.Errorf("error getting valkey connection: %w", err)
+	}
+	defer vc.Close()
+
+	if _, err := scriptSet.DoContext(ctx, vc, vkey, t.keysKey(), data, t.ttl.Milliseconds()); err != nil {
+		return fmt.Errorf("error setting cached item: %w", err)
+	}
+	return nil
+}
+
+// sets an item and tracks its key, with the set of keys expiring along with the most recently set item, or neither
+// expiring if the TTL is zero
+var scriptSet = valkey.NewScript(2, `
+local ttl = tonumber(ARGV[2])
+if ttl > 0 then
+	redis.call("SET", KEYS[1], ARGV[1], "PX", ttl)
+	redis.call("SADD", KEYS[2], KEYS[1])
+	redis.call("PEXPIRE", KEYS[2], ttl)
+else
+	redis.call("SET", KEYS[1], ARGV[1])
+	redis.call("SADD", KEYS[2], KEYS[1])
+	redis.call("PERSIST", KEYS[2])
+end
+return 1`)
+
+// lock tries to acquire the lock for fetching the given item, returning a token which is needed to release it
+func (t *Tiered[K, V]) lock(ctx context.Context, vkey string) (string, bool, error) {
+	b := make([]byte, 16)
+	rand.Read(b)
+	token := hex.EncodeToString(b)
+
+	vc, err := t.vp.GetContext(ctx)
+	if err != nil {
+		return "", false, fmt.Errorf("error getting valkey connection: %w", err)
+	}
+	defer vc.Close()
+
+	_, err = valkey.String(valkey.DoContext(vc, ctx, "SET", vkey+":lock", token, "NX", "PX", tieredLockTTL.Milliseconds()))
+	if err == valkey.ErrNil {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("error acquiring fetch lock: %w", err)
+	}
+	return token, true, nil
+}
+
+var scriptUnlock = valkey.NewScript(1, `if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("DEL", KEYS[1]) end return 0`)
+
+// unlock releases the lock for fetching the given item, if it's still held with the given token
+func (t *Tiered[K, V]) unlock(ctx context.Context, vkey, token string) {
+	vc, err := t.vp.GetContext(ctx)
+	if err != nil {
+		return
+	}
+	defer vc.Close()
+
+	scriptUnlock.DoContext(ctx, vc, vkey+":lock", token)
+}
+
+func (t *Tiered[K, V]) remoteKey(key K) string {
+	return t.keyPrefix + fmt.Sprint(key)
+}
+
+// keysKey is the key of the set which tracks the keys of items in valkey
+func (t *Tiered[K, V]) keysKey() string {
+	return t.keyPrefix + ":keys"
+}
@@ -0,0 +1,217 @@
+package cache_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	valkey "github.com/gomodule/redigo/redis"
+	"github.com/nyaruka/gocommon/cache"
+	"github.com/nyaruka/vkutil/assertvk"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTiered(t *testing.T) {
+	ctx := context.Background()
+	vp := assertvk.TestDB()
+	vc := vp.Get()
+	defer vc.Close()
+
+	defer assertvk.FlushDB()
+
+	fetchCounts := make(map[string]int)
+	fetchCountsMutex := &sync.Mutex{}
+
+	fetch := func(ctx context.Context, k string) (string, error) {
+		fetchCountsMutex.Lock()
+		fetchCounts[k]++
+		fc := fetchCounts[k]
+		fetchCountsMutex.Unlock()
+
+		if k == "error" {
+			return "", errors.New("boom")
+		} else if k == "slow" {
+			time.Sleep(250 * time.Millisecond)
+		}
+		return fmt.Sprintf("%s/%d", strings.ToUpper(k), fc), nil
+	}
+
+	// two caches sharing the same valkey tier, like two processes
+	cache1 := cache.NewTiered[string, string](fetch, vp, "test:", time.Second, 5*time.Second, nil)
+	cache2 := cache.NewTiered[string, string](fetch, vp, "test:", time.Second, 5*time.Second, nil)
+
+	v, err := cache1.GetOrFetch(ctx, "x")
+	assert.NoError(t, err)
+	assert.Equal(t, "X/1", v)
+	assert.Equal(t, map[string]int{"x": 1}, fetchCounts)
+	assert.Equal(t, 1, cache1.Len())
+
+	stored, err := valkey.String(vc.Do("GET", "test:x"))
+	assert.NoError(t, err)
+	assert.Equal(t, `"X/1"`, stored)
+
+	// its key is tracked so that the cache can be cleared
+	tracked, err := valkey.Strings(vc.Do("SMEMBERS", "test::keys"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"test:x"}, tracked)
+
+	// second cache finds it in valkey without fetching
+	v, err = cache2.GetOrFetch(ctx, "x")
+	assert.NoError(t, err)
+	assert.Equal(t, "X/1", v)
+	assert.Equal(t, map[string]int{"x": 1}, fetchCounts)
+	assert.Equal(t, 1, cache2.Len())
+
+	// local tier is checked before valkey
+	_, err = vc.Do("SET", "test:x", `"X/99"`)
+	assert.NoError(t, err)
+
+	v, err = cache1.GetOrFetch(ctx, "x")
+	assert.NoError(t, err)
+	assert.Equal(t, "X/1", v)
+
+	// until the local item is cleared
+	cache1.Clear()
+
+	v, err = cache1.GetOrFetch(ctx, "x")
+	assert.NoError(t, err)
+	assert.Equal(t, "X/99", v)
+
+	// errors aren't cached in either tier
+	_, err = cache1.GetOrFetch(ctx, "error")
+	assert.EqualError(t, err, "boom")
+	_, err = cache2.GetOrFetch(ctx, "error")
+	assert.EqualError(t, err, "boom")
+	assert.Equal(t, 2, fetchCounts["error"])
+
+	exists, err := valkey.Bool(vc.Do("EXISTS", "test:error"))
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	// concurrent fetches of the same item across both caches only fetch it once
+	wg := &sync.WaitGroup{}
+	for _, c := range []*cache.Tiered[string, string]{cache1, cache2} {
+		for range 5 {
+			wg.Go(func() {
+				v, err := c.GetOrFetch(ctx, "slow")
+				assert.NoError(t, err)
+				assert.Equal(t, "SLOW/1", v)
+			})
+		}
+	}
+	wg.Wait()
+
+	assert.Equal(t, 1, fetchCounts["slow"])
+
+	// setting an item updates both tiers
+	assert.NoError(t, cache2.Set(ctx, "y", "Y/X"))
+
+	stored, err = valkey.String(vc.Do("GET", "test:y"))
+	assert.NoError(t, err)
+	assert.Equal(t, `"Y/X"`, stored)
+
+	v, err = cache1.GetOrFetch(ctx, "y")
+	assert.NoError(t, err)
+	assert.Equal(t, "Y/X", v)
+	assert.Equal(t, 0, fetchCounts["y"])
+
+	// a process waiting on another's lock fetches the item itself if the lock is released without the item appearing
+	_, err = vc.Do("SET", "test:z:lock", "other", "PX", 60000)
+	assert.NoError(t, err)
+
+	time.AfterFunc(200*time.Millisecond, func() {
+		vc := vp.Get()
+		defer vc.Close()
+		vc.Do("DEL", "test:z:lock")
+	})
+
+	start := time.Now()
+	v, err = cache1.GetOrFetch(ctx, "z")
+	assert.NoError(t, err)
+	assert.Equal(t, "Z/1", v)
+	assert.Less(t, time.Since(start), 5*time.Second)
+
+	// while waiting, a cancelled context is an error
+	_, err = vc.Do("SET", "test:w:lock", "other", "PX", 60000)
+	assert.NoError(t, err)
+
+	cancelCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	_, err = cache1.GetOrFetch(cancelCtx, "w")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, 0, fetchCounts["w"])
+}
+
+func TestTieredNoRemoteTTL(t *testing.T) {
+	ctx := context.Background()
+	vp := assertvk.TestDB()
+	vc := vp.Get()
+	defer vc.Close()
+
+	defer assertvk.FlushDB()
+
+	fetch := func(ctx context.Context, k string) (string, error) { return strings.ToUpper(k), nil }
+
+	// a zero remote TTL means items don't expire from valkey
+	c := cache.NewTiered[string, string](fetch, vp, "test:", time.Second, 0, nil)
+
+	v, err := c.GetOrFetch(ctx, "x")
+	assert.NoError(t, err)
+	assert.Equal(t, "X", v)
+
+	for _, key := range []string{"test:x", "test::keys"} {
+		ttl, err := valkey.Int(vc.Do("PTTL", key))
+		assert.NoError(t, err)
+		assert.Equal(t, -1, ttl, "ttl mismatch for %s", key)
+	}
+
+	// and a prefix is required so that items can be told apart from other keys
+	assert.Panics(t, func() { cache.NewTiered[string, string](fetch, vp, "", time.Second, 0, nil) })
+}
+
+type failingCodec struct{ cache.JSONCodec[string] }
+
+func (c failingCodec) Encode(v string) ([]byte, error) {
+	if v == "BAD/1" {
+		return nil, errors.New("can't encode")
+	}
+	return c.JSONCodec.Encode(v)
+}
+
+func TestTieredValkeyErrors(t *testing.T) {
+	ctx := context.Background()
+	vp := assertvk.TestDB()
+	vc := vp.Get()
+	defer vc.Close()
+
+	defer assertvk.FlushDB()
+
+	fetch := func(ctx context.Context, k string) (string, error) { return strings.ToUpper(k) + "/1", nil }
+
+	c := cache.NewTiered[string, string](fetch, vp, "test:", time.Second, 5*time.Second, failingCodec{})
+
+	// an item in valkey which can't be read is fetched instead, and replaced
+	_, err := vc.Do("SET", "test:corrupt", "{")
+	assert.NoError(t, err)
+
+	v, err := c.GetOrFetch(ctx, "corrupt")
+	assert.NoError(t, err)
+	assert.Equal(t, "CORRUPT/1", v)
+
+	stored, err := valkey.String(vc.Do("GET", "test:corrupt"))
+	assert.NoError(t, err)
+	assert.Equal(t, `"CORRUPT/1"`, stored)
+
+	// an item which can't be stored in valkey is still returned
+	v, err = c.GetOrFetch(ctx, "bad")
+	assert.NoError(t, err)
+	assert.Equal(t, "BAD/1", v)
+
+	exists, err := valkey.Bool(vc.Do("EXISTS", "test:bad"))
+	assert.NoError(t, err)
+	assert.False(t, exists)
+}
@@ -5,13 +5,37 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"slices"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
+
+	"github.com/nyaruka/gocommon/stringsx"
 )
 
-// AccessConfig configures what can be accessed
+// AccessConfig configures what can be accessed. Requests are checked against its rules in the order the fields are
+// listed here, and are denied by the first rule they fail.
 type AccessConfig struct {
 	ResolveTimeout time.Duration
+
+	// AllowedSchemes, if non-empty, are the only URL schemes which can be requested
+	AllowedSchemes []string
+
+	// AllowedPorts, if non-empty, are the only ports which can be requested, with the scheme's default port used
+	// for URLs which don't specify one
+	AllowedPorts []int
+
+	// DisallowedHosts are patterns (see stringsx.GlobMatch) of hostnames which can't be requested
+	DisallowedHosts []string
+
+	// AllowedHosts, if non-empty, are patterns of the only hostnames which can be requested
+	AllowedHosts []string
+
+	// TrustedHosts are patterns of hostnames which are exempt from the IP and network checks below, e.g. internal
+	// services which resolve to private addresses but should still be reachable
+	TrustedHosts []string
+
 	DisallowedIPs  []net.IP
 	DisallowedNets []*net.IPNet
 }
@@ -25,64 +49,120 @@ func NewAccessConfig(resolveTimeout time.Duration, disallowedIPs []net.IP, disal
 	}
 }
 
+// AccessDeniedError is returned when a request is denied by an access config, and describes which rule denied it
+type AccessDeniedError struct {
+	Reason string
+}
+
+func (e *AccessDeniedError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrAccessConfig.Error(), e.Reason)
+}
+
+// Unwrap allows errors.Is(err, ErrAccessConfig) to match any access denial
+func (e *AccessDeniedError) Unwrap() error {
+	return ErrAccessConfig
+}
+
+func denied(format string, a ...any) *AccessDeniedError {
+	return &AccessDeniedError{Reason: fmt.Sprintf(format, a...)}
+}
+
 // Allow determines whether the given request should be allowed
 func (c *AccessConfig) Allow(request *http.Request) (bool, error) {
+	err := c.Check(request)
+	if _, isDenied := err.(*AccessDeniedError); isDenied {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Check applies the access config to the request, returning an *AccessDeniedError describing the rule which denied
+// it, or the underlying error if the access check itself fails. A nil config permits everything.
+func (c *AccessConfig) Check(request *http.Request) error {
+	if c == nil {
+		return nil
+	}
+
+	scheme := strings.ToLower(request.URL.Scheme)
 	host := strings.ToLower(request.URL.Hostname())
+	port := request.URL.Port()
+	if port == "" {
+		port = defaultPorts[scheme]
+	}
+
+	if len(c.AllowedSchemes) > 0 && !slices.ContainsFunc(c.AllowedSchemes, func(s string) bool { return strings.EqualFold(s, scheme) }) {
+		return denied("scheme '%s' is not allowed", scheme)
+	}
+	if len(c.AllowedPorts) > 0 && !slices.ContainsFunc(c.AllowedPorts, func(p int) bool { return strconv.Itoa(p) == port }) {
+		return denied("port %s is not allowed", port)
+	}
+	if pattern, matched := matchHost(host, c.DisallowedHosts); matched {
+		return denied("host '%s' matches disallowed host '%s'", host, pattern)
+	}
+	if _, matched := matchHost(host, c.AllowedHosts); len(c.AllowedHosts) > 0 && !matched {
+		return denied("host '%s' doesn't match any allowed host", host)
+	}
+	if _, trusted := matchHost(host, c.TrustedHosts); trusted {
+		return nil
+	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), c.ResolveTimeout)
 	defer cancel()
 
 	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
 	if err != nil {
-		return false, err
+		return err
 	}
 
 	// if any of the host's addresses appear in the disallowed list, deny the request
 	for _, addr := range addrs {
-		// Normalize IPv4-in-IPv6 to 4-byte form so an IPv4-mapped IPv6 address can't bypass
-		// an IPv4 rule by being expressed as ::ffff:x.x.x.x.
-		ip := addr.IP
-		isV4 := ip.To4() != nil
-		if isV4 {
-			ip = ip.To4()
+		if err := c.checkIP(addr.IP); err != nil {
+			return err
 		}
-		for _, disallowed := range c.DisallowedIPs {
-			if ip.Equal(disallowed) {
-				return false, nil
-			}
-		}
-		for _, disallowed := range c.DisallowedNets {
-			// Only check IPv4 hosts against IPv4 nets and IPv6 hosts against IPv6 nets.
-			// Without this, an IPv6 net that projects into IPv4 space (e.g. ::ffff:0:0/96)
-			// would match every IPv4 host, because IPNet.Contains strips the ::ffff: prefix
-			// internally and compares as IPv4. Use mask size for family detection because
-			// the net's IP can be stored in 16-byte form even for IPv4 (e.g. when built via
-			// net.IPv4 without To4), but the mask reliably reflects the intended family.
-			_, maskBits := disallowed.Mask.Size()
-			netIsV4 := maskBits == 32
-			if isV4 != netIsV4 {
-				continue
-			}
-			if disallowed.Contains(ip) {
-				return false, nil
-			}
+	}
+	return nil
+}
+
+var defaultPorts = map[string]string{"http": "80", "https": "443"}
+
+// matchHost returns the first of the given patterns which matches the given lowercase hostname
+func matchHost(host string, patterns []string) (string, bool) {
+	for _, pattern := range patterns {
+		if stringsx.GlobMatch(host, strings.ToLower(pattern)) {
+			return pattern, true
 		}
 	}
-	return true, nil
+	return "", false
 }
 
-// check applies the access config to the request, returning ErrAccessConfig if the request is denied, or the
-// underlying error if the access check itself fails. A nil config permits everything.
-func (c *AccessConfig) check(request *http.Request) error {
-	if c == nil {
-		return nil
+// checkIP checks the given IP address against the disallowed IPs and networks
+func (c *AccessConfig) checkIP(ip net.IP) error {
+	// Normalize IPv4-in-IPv6 to 4-byte form so an IPv4-mapped IPv6 address can't bypass
+	// an IPv4 rule by being expressed as ::ffff:x.x.x.x.
+	isV4 := ip.To4() != nil
+	if isV4 {
+		ip = ip.To4()
 	}
-	allowed, err := c.Allow(request)
-	if err != nil {
-		return err
+	for _, disallowed := range c.DisallowedIPs {
+		if ip.Equal(disallowed) {
+			return denied("IP %s is disallowed", ip)
+		}
 	}
-	if !allowed {
-		return ErrAccessConfig
+	for _, disallowed := range c.DisallowedNets {
+		// Only check IPv4 hosts against IPv4 nets and IPv6 hosts against IPv6 nets.
+		// Without this, an IPv6 net that projects into IPv4 space (e.g. ::ffff:0:0/96)
+		// would match every IPv4 host, because IPNet.Contains strips the ::ffff: prefix
+		// internally and compares as IPv4. Use mask size for family detection because
+		// the net's IP can be stored in 16-byte form even for IPv4 (e.g. when built via
+		// net.IPv4 without To4), but the mask reliably reflects the intended family.
+		_, maskBits := disallowed.Mask.Size()
+		netIsV4 := maskBits == 32
+		if isV4 != netIsV4 {
+			continue
+		}
+		if disallowed.Contains(ip) {
+			return denied("IP %s is in disallowed network %s", ip, disallowed)
+		}
 	}
 	return nil
 }
@@ -104,7 +184,7 @@ func WithAccessControl(inner http.RoundTripper, access *AccessConfig) http.Round
 }
 
 func (t *accessTransport) RoundTrip(request *http.Request) (*http.Response, error) {
-	if err := t.access.check(request); err != nil {
+	if err := t.access.Check(request); err != nil {
 		// the http.RoundTripper contract requires the request body to be closed even on error paths
 		if request.Body != nil {
 			request.Body.Close()
@@ -114,6 +194,76 @@ func (t *accessTransport) RoundTrip(request *http.Request) (*http.Response, erro
 	return t.inner.RoundTrip(request)
 }
 
+// DialContext returns a dial function, suitable for http.Transport.DialContext, which uses the given dialer but refuses
+// to connect to any address disallowed by this access config. Unlike Allow, which resolves the hostname separately
+// from the connection that's eventually made, this checks the IP actually being connected to, so a DNS server which
+// answers differently on a second lookup (DNS rebinding) can't be used to reach a disallowed address. Connections to
+// trusted hosts aren't checked. A denied connection fails with an error wrapping an *AccessDeniedError. If dialer is
+// nil then a zero net.Dialer is used.
+func (c *AccessConfig) DialContext(dialer *net.Dialer) func(context.Context, string, string) (net.Conn, error) {
+	d := &net.Dialer{}
+	if dialer != nil {
+		*d = *dialer
+	}
+	trusted := *d
+
+	// Control is called with the resolved address just before each connection attempt, including each fallback
+	// address tried when a host resolves to several
+	control := d.Control
+	d.Control = func(network, address string, conn syscall.RawConn) error {
+		if err := c.checkAddress(address); err != nil {
+			return err
+		}
+		if control != nil {
+			return control(network, address, conn)
+		}
+		return nil
+	}
+
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		if c != nil {
+			if host, _, err := net.SplitHostPort(address); err == nil {
+				if _, isTrusted := matchHost(strings.ToLower(host), c.TrustedHosts); isTrusted {
+					return trusted.DialContext(ctx, network, address)
+				}
+			}
+		}
+		return d.DialContext(ctx, network, address)
+	}
+}
+
+// checkAddress checks the given resolved host:port address which is about to be connected to. A nil config permits
+// everything.
+func (c *AccessConfig) checkAddress(address string) error {
+	if c == nil {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return denied("address '%s' is not an IP", host)
+	}
+	return c.checkIP(ip)
+}
+
+// NewAccessTransport creates a transport which enforces the given access config at dial time as well as on each
+// request. It's a clone of http.DefaultTransport whose connections are made with DialContext, wrapped with
+// WithAccessControl.
+//
+// Every connection is checked, so a redirect to a disallowed address fails when the client dials it, as does a
+// proxy (e.g. one configured via HTTP_PROXY) which is itself at a disallowed address. A proxy resolves the target
+// host itself though, so for a proxied request only the name-based check made by WithAccessControl applies to the
+// target, and the proxy must be trusted to not connect to internal addresses.
+func NewAccessTransport(access *AccessConfig) http.RoundTripper {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = access.DialContext(&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second})
+
+	return WithAccessControl(transport, access)
+}
+
 // ParseNetworks parses a list of IPs and IP networks (written in CIDR notation)
 func ParseNetworks(addrs ...string) ([]net.IP, []*net.IPNet, error) {
 	ips := make([]net.IP, 0, len(addrs))
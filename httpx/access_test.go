@@ -4,6 +4,10 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"syscall"
 	"testing"
 	"time"
 
@@ -95,13 +99,14 @@ func TestAccessTransport(t *testing.T) {
 	assert.Equal(t, 200, resp.StatusCode)
 	assert.Len(t, inner.Requests(), 1)
 
-	// disallowed request returns ErrAccessConfig and never reaches the inner transport
+	// disallowed request returns an error describing the rule and never reaches the inner transport
 	inner = httpx.WithMocks(http.DefaultTransport, map[string][]*httpx.MockResponse{})
 	transport = httpx.WithAccessControl(inner, access)
 	req, err = http.NewRequest("GET", "https://127.0.0.1", nil)
 	require.NoError(t, err)
 	resp, err = transport.RoundTrip(req)
-	assert.Equal(t, httpx.ErrAccessConfig, err)
+	assert.ErrorIs(t, err, httpx.ErrAccessConfig)
+	assert.EqualError(t, err, "request not permitted by access config: IP 127.0.0.1 is disallowed")
 	assert.Nil(t, resp)
 	assert.Empty(t, inner.Requests())
 
@@ -112,7 +117,7 @@ func TestAccessTransport(t *testing.T) {
 	req, err = http.NewRequest("POST", "https://127.0.0.1", body)
 	require.NoError(t, err)
 	resp, err = transport.RoundTrip(req)
-	assert.Equal(t, httpx.ErrAccessConfig, err)
+	assert.ErrorIs(t, err, httpx.ErrAccessConfig)
 	assert.Nil(t, resp)
 	assert.True(t, body.closed, "request body should be closed on the deny path")
 	assert.Empty(t, inner.Requests())
@@ -126,7 +131,7 @@ func TestAccessTransport(t *testing.T) {
 	require.NoError(t, err)
 	resp, err = transport.RoundTrip(req)
 	assert.Error(t, err)
-	assert.NotEqual(t, httpx.ErrAccessConfig, err)
+	assert.NotErrorIs(t, err, httpx.ErrAccessConfig)
 	assert.Nil(t, resp)
 	assert.Empty(t, inner.Requests())
 
@@ -137,7 +142,7 @@ func TestAccessTransport(t *testing.T) {
 	req, err = http.NewRequest("GET", "https://127.0.0.1", nil)
 	require.NoError(t, err)
 	resp, err = transport.RoundTrip(req)
-	assert.Equal(t, httpx.ErrAccessConfig, err)
+	assert.ErrorIs(t, err, httpx.ErrAccessConfig)
 	assert.Nil(t, resp)
 
 	// a nil access config is a pass-through, even for an otherwise-denied host
@@ -153,6 +158,136 @@ func TestAccessTransport(t *testing.T) {
 	assert.Len(t, inner.Requests(), 1)
 }
 
+func TestAccessConfigRules(t *testing.T) {
+	access := &httpx.AccessConfig{
+		ResolveTimeout:  30 * time.Second,
+		AllowedSchemes:  []string{"https", "http"},
+		AllowedPorts:    []int{80, 443},
+		DisallowedHosts: []string{"*.internal", "metadata"},
+		AllowedHosts:    []string{"localhost", "*.localhost", "127.0.0.*", "10.*"},
+		TrustedHosts:    []string{"api.localhost"},
+		DisallowedIPs:   []net.IP{net.ParseIP("127.0.0.1")},
+		DisallowedNets:  []*net.IPNet{{IP: net.IPv4(10, 0, 0, 0).To4(), Mask: net.CIDRMask(8, 32)}},
+	}
+
+	tests := []struct {
+		url    string
+		reason string
+	}{
+		{"ftp://localhost", "scheme 'ftp' is not allowed"},
+		{"HTTPS://api.localhost", ""},
+		{"https://localhost:8080", "port 8080 is not allowed"},
+		{"http://api.localhost:80", ""},
+		{"https://foo.internal", "host 'foo.internal' matches disallowed host '*.internal'"},
+		{"https://METADATA", "host 'metadata' matches disallowed host 'metadata'"},
+		{"https://nyaruka.com", "host 'nyaruka.com' doesn't match any allowed host"},
+		{"https://localhost", "IP 127.0.0.1 is disallowed"},
+		{"https://127.0.0.2", ""},
+		{"https://10.1.2.3", "IP 10.1.2.3 is in disallowed network 10.0.0.0/8"},
+	}
+	for _, tc := range tests {
+		request, err := http.NewRequest("GET", tc.url, nil)
+		require.NoError(t, err)
+
+		err = access.Check(request)
+		allowed, allowErr := access.Allow(request)
+		assert.NoError(t, allowErr, "unexpected error for url %s", tc.url)
+
+		if tc.reason == "" {
+			assert.NoError(t, err, "unexpected error for url %s", tc.url)
+			assert.True(t, allowed, "allowed mismatch for url %s", tc.url)
+		} else {
+			var denied *httpx.AccessDeniedError
+			if assert.ErrorAs(t, err, &denied, "expected denial for url %s", tc.url) {
+				assert.Equal(t, tc.reason, denied.Reason, "reason mismatch for url %s", tc.url)
+			}
+			assert.ErrorIs(t, err, httpx.ErrAccessConfig)
+			assert.False(t, allowed, "allowed mismatch for url %s", tc.url)
+		}
+	}
+
+	// a nil config permits everything
+	request, _ := http.NewRequest("GET", "ftp://127.0.0.1:21", nil)
+	assert.NoError(t, (*httpx.AccessConfig)(nil).Check(request))
+}
+
+func TestAccessDialContext(t *testing.T) {
+	ctx := t.Context()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, "http://10.1.2.3/", http.StatusFound)
+			return
+		}
+		w.Write([]byte("OK"))
+	}))
+	defer server.Close()
+
+	access := httpx.NewAccessConfig(30*time.Second, []net.IP{net.ParseIP("169.254.169.254")}, []*net.IPNet{{IP: net.IPv4(10, 0, 0, 0).To4(), Mask: net.CIDRMask(8, 32)}})
+	dial := access.DialContext(nil)
+
+	// an allowed address connects as normal
+	conn, err := dial(ctx, "tcp", server.Listener.Addr().String())
+	require.NoError(t, err)
+	conn.Close()
+
+	// a disallowed address is refused before any connection is made
+	_, err = dial(ctx, "tcp", "169.254.169.254:80")
+	assert.ErrorIs(t, err, httpx.ErrAccessConfig)
+	_, err = dial(ctx, "tcp", "10.1.2.3:80")
+	assert.ErrorIs(t, err, httpx.ErrAccessConfig)
+	_, err = dial(ctx, "tcp", "[::ffff:10.1.2.3]:80")
+	assert.ErrorIs(t, err, httpx.ErrAccessConfig)
+
+	// the check applies to the resolved address, not the name that was asked for
+	denyLocal := httpx.NewAccessConfig(30*time.Second, []net.IP{net.ParseIP("127.0.0.1")}, nil)
+	_, err = denyLocal.DialContext(nil)(ctx, "tcp4", strings.Replace(server.Listener.Addr().String(), "127.0.0.1", "localhost", 1))
+	assert.ErrorIs(t, err, httpx.ErrAccessConfig)
+
+	// but not for a trusted host
+	denyLocal.TrustedHosts = []string{"localhost"}
+	conn, err = denyLocal.DialContext(nil)(ctx, "tcp4", strings.Replace(server.Listener.Addr().String(), "127.0.0.1", "localhost", 1))
+	require.NoError(t, err)
+	conn.Close()
+	denyLocal.TrustedHosts = nil
+
+	// an existing control function on the dialer is still called for allowed addresses
+	controlled := 0
+	dial = access.DialContext(&net.Dialer{Control: func(string, string, syscall.RawConn) error { controlled++; return nil }})
+	conn, err = dial(ctx, "tcp", server.Listener.Addr().String())
+	require.NoError(t, err)
+	conn.Close()
+	_, err = dial(ctx, "tcp", "10.1.2.3:80")
+	assert.ErrorIs(t, err, httpx.ErrAccessConfig)
+	assert.Equal(t, 1, controlled)
+
+	// a redirect to a disallowed address is refused when the client dials it
+	client := &http.Client{Transport: &http.Transport{DialContext: access.DialContext(nil)}}
+	resp, err := client.Get(server.URL + "/ok")
+	require.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	resp.Body.Close()
+
+	_, err = client.Get(server.URL + "/redirect")
+	assert.ErrorIs(t, err, httpx.ErrAccessConfig)
+
+	// as is a proxy at a disallowed address
+	proxyURL, _ := url.Parse("http://10.1.2.3:3128")
+	client = &http.Client{Transport: &http.Transport{DialContext: access.DialContext(nil), Proxy: http.ProxyURL(proxyURL)}}
+	_, err = client.Get(server.URL + "/ok")
+	assert.ErrorIs(t, err, httpx.ErrAccessConfig)
+
+	// the full transport checks both the request and the dialed address
+	client = &http.Client{Transport: httpx.NewAccessTransport(denyLocal)}
+	_, err = client.Get(server.URL + "/ok")
+	assert.ErrorIs(t, err, httpx.ErrAccessConfig)
+
+	client = &http.Client{Transport: httpx.NewAccessTransport(access)}
+	resp, err = client.Get(server.URL + "/ok")
+	require.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	resp.Body.Close()
+}
+
 func TestParseNetworkList(t *testing.T) {
 	privateNetwork1 := &net.IPNet{IP: net.IPv4(10, 0, 0, 0).To4(), Mask: net.CIDRMask(8, 32)}
 	privateNetwork2 := &net.IPNet{IP: net.IPv4(172, 16, 0, 0).To4(), Mask: net.CIDRMask(12, 32)}
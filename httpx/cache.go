@@ -0,0 +1,430 @@
+package httpx
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nyaruka/gocommon/dates"
+)
+
+// CacheStatus describes how a request was handled by a caching transport
+type CacheStatus string
+
+const (
+	CacheMiss        CacheStatus = "miss"        // fetched from the server, either because it wasn't cached or was changed
+	CacheHit         CacheStatus = "hit"         // answered from the cache without contacting the server
+	CacheRevalidated CacheStatus = "revalidated" // cached but stale, and the server confirmed it was unchanged
+)
+
+const (
+	// DefaultCacheMaxBodySize is the largest response body which is cached unless a different limit is given with
+	// CacheMaxBodySize
+	DefaultCacheMaxBodySize = 1024 * 1024 // 1MB
+
+	// how long a stale response with validators is kept so that it can be revalidated rather than fetched again
+	cacheRevalidateRetention = 24 * time.Hour
+
+	// the most a heuristic freshness lifetime can be, see RFC 9111 section 4.2.2
+	cacheMaxHeuristicFreshness = 24 * time.Hour
+)
+
+// statuses which can be cached without explicit freshness, see RFC 9110 section 15.1
+var cacheableStatuses = []int{200, 203, 204, 300, 301, 308, 404, 405, 410, 414, 501}
+
+// CacheOption configures a caching transport created with WithCache.
+type CacheOption func(*cacheTransport)
+
+// CacheMaxBodySize sets the largest response body which will be cached. Larger responses are passed through.
+func CacheMaxBodySize(n int) CacheOption {
+	return func(t *cacheTransport) { t.maxBodySize = n }
+}
+
+// cacheTransport is an http.RoundTripper which answers requests from a cache of previous responses where possible,
+// delegating to an inner transport. It is safe for concurrent use by multiple goroutines, as the http.RoundTripper
+// contract requires.
+type cacheTransport struct {
+	inner       http.RoundTripper
+	store       CacheStore
+	maxBodySize int
+}
+
+// WithCache wraps an http.RoundTripper so that responses to GET requests are cached in the given store, as a shared
+// cache as described by RFC 9111 since the store may be used by multiple clients. A cached response is returned without
+// contacting the server while it's fresh according to its Cache-Control or Expires headers, or a heuristic based on its
+// Last-Modified header. Once stale, a response with an ETag or Last-Modified header is revalidated with a conditional
+// request, and reused if the server responds 304 Not Modified. Responses with a Vary header are only reused for
+// requests with the same values of the listed headers. Requests with unsafe methods such as POST invalidate the cached
+// response for their URL.
+//
+// Responses marked private are never stored, and requests with an Authorization header are only answered from the
+// cache, or have their responses stored, if the response is marked public, or has s-maxage or must-revalidate.
+//
+// Errors from the store are treated as cache misses so that a failing store doesn't fail requests. Requests which
+// are already conditional, or have Cache-Control: no-store, are passed straight through. If inner is nil then
+// http.DefaultTransport is used.
+//
+// Compose this inside WithTraces and the trace of each GET request records how it was handled as Trace.Cache:
+//
+//	httpx.WithTraces(httpx.WithCache(httpx.WithRetries(inner, retries), store))
+func WithCache(inner http.RoundTripper, store CacheStore, opts ...CacheOption) http.RoundTripper {
+	if inner == nil {
+		inner = http.DefaultTransport
+	}
+	t := &cacheTransport{inner: inner, store: store, maxBodySize: DefaultCacheMaxBodySize}
+	for _, opt := range opts {
+		opt(t)
+	}
+	return t
+}
+
+func (t *cacheTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	ctx := request.Context()
+	key := request.URL.String()
+
+	if request.Method != http.MethodGet {
+		response, err := t.inner.RoundTrip(request)
+
+		// a successful unsafe request may have changed the resource so whatever we have cached is now invalid
+		if err == nil && !isSafeMethod(request.Method) && response.StatusCode < 400 {
+			t.store.Delete(ctx, key)
+		}
+		return response, err
+	}
+
+	reqCC := parseCacheControl(request.Header)
+	if reqCC.has("no-store") || isConditional(request) {
+		return t.inner.RoundTrip(request)
+	}
+
+	entry := t.lookup(request, key)
+	if entry != nil {
+		age := entry.age(dates.Now())
+		if entry.isFresh(age, reqCC) {
+			recordCacheStatus(request, CacheHit)
+			return entry.response(request, age), nil
+		}
+	}
+
+	// if we have a stale response with validators, ask the server if it has changed rather than fetching it again
+	send := request
+	if entry != nil && entry.hasValidators() {
+		send = request.Clone(ctx)
+		if etag := entry.Header.Get("ETag"); etag != "" {
+			send.Header.Set("If-None-Match", etag)
+		}
+		if lastModified := entry.Header.Get("Last-Modified"); lastModified != "" {
+			send.Header.Set("If-Modified-Since", lastModified)
+		}
+	}
+
+	requestTime := dates.Now()
+	response, err := t.inner.RoundTrip(send)
+	if err != nil {
+		return nil, err
+	}
+	responseTime := dates.Now()
+
+	if send != request && response.StatusCode == http.StatusNotModified {
+		io.Copy(io.Discard, response.Body)
+		response.Body.Close()
+
+		entry.update(response, requestTime, responseTime)
+		t.save(request, key, entry)
+
+		recordCacheStatus(request, CacheRevalidated)
+		return entry.response(request, 0), nil
+	}
+
+	recordCacheStatus(request, CacheMiss)
+
+	if !isCacheable(request, response) {
+		return response, nil
+	}
+
+	// read the body so we can cache it, but give up if it's too big and pass on what we've read with the rest
+	body, err := io.ReadAll(io.LimitReader(response.Body, int64(t.maxBodySize)+1))
+	if err != nil {
+		response.Body.Close()
+		return nil, err
+	}
+	if len(body) > t.maxBodySize {
+		response.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), response.Body), response.Body}
+		return response, nil
+	}
+	response.Body.Close()
+	response.Body = io.NopCloser(bytes.NewReader(body))
+
+	entry = &cacheEntry{
+		RequestTime:  requestTime,
+		ResponseTime: responseTime,
+		Vary:         varyValues(request, response.Header),
+		Status:       response.StatusCode,
+		Header:       response.Header.Clone(),
+		Body:         body,
+	}
+	t.save(request, key, entry)
+
+	return response, nil
+}
+
+// lookup returns the cached entry for the given request, or nil if there isn't one which can be used for it
+func (t *cacheTransport) lookup(request *http.Request, key string) *cacheEntry {
+	data, err := t.store.Get(request.Context(), key)
+	if err != nil || data == nil {
+		return nil
+	}
+
+	entry := &cacheEntry{}
+	if err := json.Unmarshal(data, entry); err != nil {
+		return nil
+	}
+
+	// a response to a request with credentials can only be reused for other requests with credentials if it says so
+	if request.Header.Get("Authorization") != "" && !parseCacheControl(entry.Header).allowsAuthorized() {
+		return nil
+	}
+
+	// a response which varies by request headers can only be used for a request with the same values of those
+	for name, value := range entry.Vary {
+		if strings.Join(request.Header.Values(name), ", ") != value {
+			return nil
+		}
+	}
+
+	return entry
+}
+
+// save stores the given entry for as long as it's fresh, or longer if it can be revalidated
+func (t *cacheTransport) save(request *http.Request, key string, entry *cacheEntry) {
+	ttl := entry.freshness() - entry.age(dates.Now())
+	if entry.hasValidators() {
+		ttl = max(ttl, 0) + cacheRevalidateRetention
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	t.store.Set(request.Context(), key, data, ttl)
+}
+
+var _ http.RoundTripper = (*cacheTransport)(nil)
+
+// cacheEntry is a cached response along with what we need to know to decide if it can be reused
+type cacheEntry struct {
+	RequestTime  time.Time         `json:"request_time"`
+	ResponseTime time.Time         `json:"response_time"`
+	Vary         map[string]string `json:"vary,omitempty"` // values of request headers the response varies by
+	Status       int               `json:"status"`
+	Header       http.Header       `json:"header"`
+	Body         []byte            `json:"body"`
+}
+
+// age calculates the current age of the cached response, see RFC 9111 section 4.2.3
+func (e *cacheEntry) age(now time.Time) time.Duration {
+	date := e.date()
+	ageValue, _ := strconv.Atoi(e.Header.Get("Age"))
+
+	apparentAge := max(e.ResponseTime.Sub(date), 0)
+	responseDelay := e.ResponseTime.Sub(e.RequestTime)
+	correctedAgeValue := time.Duration(ageValue)*time.Second + responseDelay
+	correctedInitialAge := max(apparentAge, correctedAgeValue)
+	residentTime := now.Sub(e.ResponseTime)
+
+	return correctedInitialAge + residentTime
+}
+
+// freshness calculates how long the cached response is fresh for, see RFC 9111 section 4.2.1
+func (e *cacheEntry) freshness() time.Duration {
+	cc := parseCacheControl(e.Header)
+
+	if sMaxAge, ok := cc.seconds("s-maxage"); ok {
+		return sMaxAge
+	}
+	if maxAge, ok := cc.seconds("max-age"); ok {
+		return maxAge
+	}
+	if expiresHeader := e.Header.Get("Expires"); expiresHeader != "" {
+		// an invalid date, e.g. 0, means already expired
+		expires, err := http.ParseTime(expiresHeader)
+		if err != nil {
+			return 0
+		}
+		return expires.Sub(e.date())
+	}
+
+	// fall back to a heuristic of 10% of the time since the response was last modified
+	if lastModified, err := http.ParseTime(e.Header.Get("Last-Modified")); err == nil && slices.Contains(cacheableStatuses, e.Status) {
+		return min(max(e.date().Sub(lastModified)/10, 0), cacheMaxHeuristicFreshness)
+	}
+	return 0
+}
+
+// isFresh returns whether the cached response can be used without revalidation by a request with the given cache
+// control directives
+func (e *cacheEntry) isFresh(age time.Duration, reqCC cacheControl) bool {
+	if reqCC.has("no-cache") || parseCacheControl(e.Header).has("no-cache") {
+		return false
+	}
+	if maxAge, ok := reqCC.seconds("max-age"); ok && age > maxAge {
+		return false
+	}
+
+	freshness := e.freshness()
+	if minFresh, ok := reqCC.seconds("min-fresh"); ok {
+		freshness -= minFresh
+	}
+	return age < freshness
+}
+
+func (e *cacheEntry) hasValidators() bool {
+	return e.Header.Get("ETag") != "" || e.Header.Get("Last-Modified") != ""
+}
+
+// date returns the value of the Date header, falling back to when the response was received
+func (e *cacheEntry) date() time.Time {
+	if date, err := http.ParseTime(e.Header.Get("Date")); err == nil {
+		return date
+	}
+	return e.ResponseTime
+}
+
+// update updates the cached response from a 304 Not Modified response, see RFC 9111 section 4.3.4
+func (e *cacheEntry) update(notModified *http.Response, requestTime, responseTime time.Time) {
+	for k, vs := range notModified.Header {
+		if k != "Content-Length" {
+			e.Header[k] = vs
+		}
+	}
+	e.RequestTime = requestTime
+	e.ResponseTime = responseTime
+}
+
+// response creates a response for the given request from this cached response
+func (e *cacheEntry) response(request *http.Request, age time.Duration) *http.Response {
+	header := e.Header.Clone()
+	header.Set("Age", strconv.Itoa(int(age/time.Second)))
+
+	return &http.Response{
+		Request:       request,
+		Status:        fmt.Sprintf("%d %s", e.Status, http.StatusText(e.Status)),
+		StatusCode:    e.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(e.Body)),
+		ContentLength: int64(len(e.Body)),
+	}
+}
+
+// isCacheable returns whether the given response to a GET request can be stored in a shared cache, see RFC 9111
+// section 3
+func isCacheable(request *http.Request, response *http.Response) bool {
+	cc := parseCacheControl(response.Header)
+	if cc.has("no-store") || cc.has("private") || response.Header.Get("Vary") == "*" {
+		return false
+	}
+
+	// a response to a request with credentials can only be stored if it says it can be shared, see section 3.5
+	if request.Header.Get("Authorization") != "" && !cc.allowsAuthorized() {
+		return false
+	}
+
+	// a response without explicit freshness can only be stored if its status allows heuristic freshness
+	_, hasMaxAge := cc.seconds("max-age")
+	_, hasSMaxAge := cc.seconds("s-maxage")
+	explicit := hasMaxAge || hasSMaxAge || response.Header.Get("Expires") != ""
+	if !explicit && !slices.Contains(cacheableStatuses, response.StatusCode) {
+		return false
+	}
+
+	// and there's no point storing a response that can't be reused without fetching it again
+	return explicit || response.Header.Get("ETag") != "" || response.Header.Get("Last-Modified") != ""
+}
+
+// isSafeMethod returns whether the given method is safe, i.e. read-only, see RFC 9110 section 9.2.1
+func isSafeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions || method == http.MethodTrace
+}
+
+func isConditional(request *http.Request) bool {
+	return request.Header.Get("If-None-Match") != "" || request.Header.Get("If-Modified-Since") != "" ||
+		request.Header.Get("If-Match") != "" || request.Header.Get("If-Unmodified-Since") != "" ||
+		request.Header.Get("Range") != ""
+}
+
+// varyValues returns the values of the request headers listed in the Vary header of the response
+func varyValues(request *http.Request, header http.Header) map[string]string {
+	var values map[string]string
+	for _, v := range header.Values("Vary") {
+		for name := range strings.SplitSeq(v, ",") {
+			if name = http.CanonicalHeaderKey(strings.TrimSpace(name)); name != "" {
+				if values == nil {
+					values = make(map[string]string)
+				}
+				values[name] = strings.Join(request.Header.Values(name), ", ")
+			}
+		}
+	}
+	return values
+}
+
+func recordCacheStatus(request *http.Request, status CacheStatus) {
+	if stats := traceStatsFromContext(request.Context()); stats != nil {
+		stats.cacheStatus.Store(status)
+	}
+}
+
+// cacheControl is a parsed Cache-Control header of directive names to values
+type cacheControl map[string]string
+
+func parseCacheControl(header http.Header) cacheControl {
+	cc := make(cacheControl)
+	for _, v := range header.Values("Cache-Control") {
+		for directive := range strings.SplitSeq(v, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			if name != "" {
+				cc[strings.ToLower(name)] = strings.Trim(value, `"`)
+			}
+		}
+	}
+	return cc
+}
+
+func (cc cacheControl) has(name string) bool {
+	_, ok := cc[name]
+	return ok
+}
+
+// allowsAuthorized returns whether a response with these directives can be stored and reused for requests with an
+// Authorization header, see RFC 9111 section 3.5
+func (cc cacheControl) allowsAuthorized() bool {
+	return cc.has("public") || cc.has("s-maxage") || cc.has("must-revalidate")
+}
+
+// seconds returns the value of the given directive as a duration, e.g. max-age=60
+func (cc cacheControl) seconds(name string) (time.Duration, bool) {
+	value, ok := cc[name]
+	if !ok {
+		return 0, false
+	}
+	secs, err := strconv.Atoi(value)
+	if err != nil || secs < 0 {
+		return 0, true // an invalid value is treated as zero, i.e. stale
+	}
+	return time.Duration(secs) * time.Second, true
+}
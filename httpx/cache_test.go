@@ -0,0 +1,239 @@
+package httpx_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nyaruka/gocommon/dates"
+	"github.com/nyaruka/gocommon/httpx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCache(t *testing.T) {
+	// control time so that we can make cached responses stale
+	now := time.Now()
+	defer dates.SetNowFunc(time.Now)
+	dates.SetNowFunc(func() time.Time { return now })
+
+	var hits atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Date", dates.Now().UTC().Format(http.TimeFormat))
+
+		switch r.URL.Path {
+		case "/fresh":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("ETag", `"v1"`)
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		case "/modified":
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Header().Set("Last-Modified", "Wed, 21 Oct 2015 07:28:00 GMT")
+			if r.Header.Get("If-Modified-Since") == "Wed, 21 Oct 2015 07:28:00 GMT" {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		case "/nostore":
+			w.Header().Set("Cache-Control", "no-store")
+		case "/vary":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("Vary", "Accept-Language")
+		}
+		w.Write([]byte("content of " + r.URL.Path))
+	}))
+	defer server.Close()
+
+	store := httpx.NewMemoryCacheStore(100)
+	transport := httpx.WithTraces(httpx.WithCache(nil, store))
+
+	ctx, traces := httpx.WithTraceCollector(context.Background())
+
+	get := func(method, path string, headers map[string]string) (string, httpx.CacheStatus) {
+		request, err := httpx.NewRequest(ctx, method, server.URL+path, nil, headers)
+		require.NoError(t, err)
+		response, err := transport.RoundTrip(request)
+		require.NoError(t, err)
+		body, err := io.ReadAll(response.Body)
+		require.NoError(t, err)
+		response.Body.Close()
+		return string(body), traces.Last().Cache
+	}
+
+	// a response with a max-age is reused until it's stale, then revalidated
+	body, status := get("GET", "/fresh", nil)
+	assert.Equal(t, "content of /fresh", body)
+	assert.Equal(t, httpx.CacheMiss, status)
+	assert.Equal(t, int32(1), hits.Load())
+
+	now = now.Add(30 * time.Second)
+
+	body, status = get("GET", "/fresh", nil)
+	assert.Equal(t, "content of /fresh", body)
+	assert.Equal(t, httpx.CacheHit, status)
+	assert.Equal(t, int32(1), hits.Load())
+	assert.Equal(t, "30", traces.Last().Response.Header.Get("Age"))
+
+	// unless the request asks for it to be revalidated
+	body, status = get("GET", "/fresh", map[string]string{"Cache-Control": "no-cache"})
+	assert.Equal(t, "content of /fresh", body)
+	assert.Equal(t, httpx.CacheRevalidated, status)
+	assert.Equal(t, int32(2), hits.Load())
+
+	now = now.Add(90 * time.Second)
+
+	body, status = get("GET", "/fresh", nil)
+	assert.Equal(t, "content of /fresh", body)
+	assert.Equal(t, httpx.CacheRevalidated, status)
+	assert.Equal(t, int32(3), hits.Load())
+
+	// revalidation refreshed the response
+	_, status = get("GET", "/fresh", nil)
+	assert.Equal(t, httpx.CacheHit, status)
+	assert.Equal(t, int32(3), hits.Load())
+
+	// a no-cache response is always revalidated, in this case with its Last-Modified date
+	_, status = get("GET", "/modified", nil)
+	assert.Equal(t, httpx.CacheMiss, status)
+	body, status = get("GET", "/modified", nil)
+	assert.Equal(t, "content of /modified", body)
+	assert.Equal(t, httpx.CacheRevalidated, status)
+	assert.Equal(t, int32(5), hits.Load())
+
+	// a no-store response is never cached
+	_, status = get("GET", "/nostore", nil)
+	assert.Equal(t, httpx.CacheMiss, status)
+	_, status = get("GET", "/nostore", nil)
+	assert.Equal(t, httpx.CacheMiss, status)
+	assert.Equal(t, int32(7), hits.Load())
+
+	// a response which varies is only reused for requests with the same header values
+	_, status = get("GET", "/vary", map[string]string{"Accept-Language": "en"})
+	assert.Equal(t, httpx.CacheMiss, status)
+	_, status = get("GET", "/vary", map[string]string{"Accept-Language": "en"})
+	assert.Equal(t, httpx.CacheHit, status)
+	_, status = get("GET", "/vary", map[string]string{"Accept-Language": "es"})
+	assert.Equal(t, httpx.CacheMiss, status)
+	assert.Equal(t, int32(9), hits.Load())
+
+	// an unsafe request invalidates the cached response and isn't itself cached
+	_, status = get("POST", "/fresh", nil)
+	assert.Equal(t, httpx.CacheStatus(""), status)
+	_, status = get("GET", "/fresh", nil)
+	assert.Equal(t, httpx.CacheMiss, status)
+	assert.Equal(t, int32(11), hits.Load())
+
+	// cache status is included in logs
+	log := httpx.NewLog(traces.Last(), 2048, 10000, nil)
+	assert.Equal(t, httpx.CacheMiss, log.Cache)
+}
+
+func TestCacheShared(t *testing.T) {
+	var hits atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+
+		switch r.URL.Path {
+		case "/private":
+			w.Header().Set("Cache-Control", "private, max-age=60")
+		case "/public":
+			w.Header().Set("Cache-Control", "public, max-age=60")
+		case "/smaxage":
+			w.Header().Set("Cache-Control", "max-age=0, s-maxage=60")
+		default:
+			w.Header().Set("Cache-Control", "max-age=60")
+		}
+		w.Write([]byte("content for " + r.Header.Get("Authorization")))
+	}))
+	defer server.Close()
+
+	store := httpx.NewMemoryCacheStore(100)
+	transport := httpx.WithTraces(httpx.WithCache(nil, store))
+
+	ctx, traces := httpx.WithTraceCollector(context.Background())
+
+	get := func(path, auth string) (string, httpx.CacheStatus) {
+		headers := map[string]string{}
+		if auth != "" {
+			headers["Authorization"] = auth
+		}
+		request, err := httpx.NewRequest(ctx, "GET", server.URL+path, nil, headers)
+		require.NoError(t, err)
+		response, err := transport.RoundTrip(request)
+		require.NoError(t, err)
+		body, err := io.ReadAll(response.Body)
+		require.NoError(t, err)
+		response.Body.Close()
+		return string(body), traces.Last().Cache
+	}
+
+	// a private response is never stored
+	get("/private", "")
+	_, status := get("/private", "")
+	assert.Equal(t, httpx.CacheMiss, status)
+	assert.Equal(t, int32(2), hits.Load())
+
+	// a response to a request with credentials isn't stored unless it says it can be shared..
+	get("/default", "Bearer alice")
+	body, status := get("/default", "Bearer bob")
+	assert.Equal(t, "content for Bearer bob", body)
+	assert.Equal(t, httpx.CacheMiss, status)
+	body, status = get("/default", "")
+	assert.Equal(t, "content for ", body)
+	assert.Equal(t, httpx.CacheMiss, status)
+	assert.Equal(t, int32(5), hits.Load())
+
+	// and a response stored for a request without credentials isn't reused for one with them
+	body, status = get("/default", "Bearer alice")
+	assert.Equal(t, "content for Bearer alice", body)
+	assert.Equal(t, httpx.CacheMiss, status)
+	_, status = get("/default", "")
+	assert.Equal(t, httpx.CacheHit, status)
+	assert.Equal(t, int32(6), hits.Load())
+
+	// responses which say they can be shared are reused, with s-maxage taking precedence over max-age
+	get("/public", "Bearer alice")
+	body, status = get("/public", "Bearer bob")
+	assert.Equal(t, "content for Bearer alice", body)
+	assert.Equal(t, httpx.CacheHit, status)
+
+	get("/smaxage", "Bearer alice")
+	body, status = get("/smaxage", "Bearer bob")
+	assert.Equal(t, "content for Bearer alice", body)
+	assert.Equal(t, httpx.CacheHit, status)
+	assert.Equal(t, int32(8), hits.Load())
+}
+
+func TestCacheMaxBodySize(t *testing.T) {
+	var hits atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte(strings.Repeat("x", 100)))
+	}))
+	defer server.Close()
+
+	store := httpx.NewMemoryCacheStore(100)
+	client := &http.Client{Transport: httpx.WithCache(nil, store, httpx.CacheMaxBodySize(50))}
+
+	for range 2 {
+		response, err := client.Get(server.URL)
+		require.NoError(t, err)
+		body, _ := io.ReadAll(response.Body)
+		response.Body.Close()
+
+		// the whole body is still returned even though it's too big to cache
+		assert.Len(t, body, 100)
+	}
+
+	assert.Equal(t, int32(2), hits.Load())
+	assert.Equal(t, 0, store.Len())
+}
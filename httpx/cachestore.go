@@ -0,0 +1,119 @@
+package httpx
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	valkey "github.com/gomodule/redigo/redis"
+	"github.com/jellydator/ttlcache/v3"
+)
+
+// CacheStore is where a caching transport created with WithCache keeps its cached responses
+type CacheStore interface {
+	// Get returns the value with the given key, or nil if there isn't one
+	Get(ctx context.Context, key string) ([]byte, error)
+
+	// Set sets the value with the given key, which the store can discard after the given TTL
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+
+	// Delete deletes the value with the given key if there is one
+	Delete(ctx context.Context, key string) error
+}
+
+// MemoryCacheStore is an in-memory cache store which holds up to a maximum number of responses, evicting the least
+// recently used when full.
+type MemoryCacheStore struct {
+	cache *ttlcache.Cache[string, []byte]
+}
+
+// NewMemoryCacheStore creates a new in-memory cache store with the given capacity
+func NewMemoryCacheStore(capacity int) *MemoryCacheStore {
+	return &MemoryCacheStore{
+		cache: ttlcache.New(
+			ttlcache.WithCapacity[string, []byte](uint64(capacity)),
+			ttlcache.WithDisableTouchOnHit[string, []byte](),
+		),
+	}
+}
+
+func (s *MemoryCacheStore) Get(ctx context.Context, key string) ([]byte, error) {
+	if item := s.cache.Get(key); item != nil {
+		return item.Value(), nil
+	}
+	return nil, nil
+}
+
+func (s *MemoryCacheStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	s.cache.Set(key, value, ttl)
+	return nil
+}
+
+func (s *MemoryCacheStore) Delete(ctx context.Context, key string) error {
+	s.cache.Delete(key)
+	return nil
+}
+
+// Len returns the number of responses in the store
+func (s *MemoryCacheStore) Len() int {
+	return s.cache.Len()
+}
+
+var _ CacheStore = (*MemoryCacheStore)(nil)
+
+// ValkeyCacheStore is a cache store which keeps responses in valkey so that they can be shared by multiple processes.
+// Responses are stored as strings with the given key prefix and expire after their TTL.
+type ValkeyCacheStore struct {
+	vp        *valkey.Pool
+	keyPrefix string
+}
+
+// NewValkeyCacheStore creates a new valkey cache store
+func NewValkeyCacheStore(vp *valkey.Pool, keyPrefix string) *ValkeyCacheStore {
+	return &ValkeyCacheStore{vp: vp, keyPrefix: keyPrefix}
+}
+
+func (s *ValkeyCacheStore) Get(ctx context.Context, key string) ([]byte, error) {
+	vc, err := s.vp.GetContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting valkey connection: %w", err)
+	}
+	defer vc.Close()
+
+	value, err := valkey.Bytes(valkey.DoContext(vc, ctx, "GET", s.keyPrefix+key))
+	if err == valkey.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error getting cached response: %w", err)
+	}
+	return value, nil
+}
+
+func (s *ValkeyCacheStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	vc, err := s.vp.GetContext(ctx)
+	if err != nil {
+		return fmt.Errorf("error getting valkey connection: %w", err)
+	}
+	defer vc.Close()
+
+	if _, err := valkey.DoContext(vc, ctx, "SET", s.keyPrefix+key, value, "PX", max(ttl.Milliseconds(), 1)); err != nil {
+		return fmt.Errorf("error setting cached response: %w", err)
+	}
+	return nil
+}
+
+func (s *ValkeyCacheStore) Delete(ctx context.Context, key string) error {
+	vc, err := s.vp.GetContext(ctx)
+	if err != nil {
+		return fmt.Errorf("error getting valkey connection: %w", err)
+	}
+	defer vc.Close()
+
+	if _, err := valkey.DoContext(vc, ctx, "DEL", s.keyPrefix+key); err != nil {
+		return fmt.Errorf("error deleting cached response: %w", err)
+	}
+	return nil
+}
+
+var _ CacheStore = (*ValkeyCacheStore)(nil)
@@ -0,0 +1,91 @@
+package httpx_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	valkey "github.com/gomodule/redigo/redis"
+	"github.com/nyaruka/gocommon/httpx"
+	"github.com/nyaruka/vkutil/assertvk"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryCacheStore(t *testing.T) {
+	ctx := context.Background()
+	store := httpx.NewMemoryCacheStore(2)
+
+	store.Set(ctx, "a", []byte("1"), time.Minute)
+	store.Set(ctx, "b", []byte("2"), time.Minute)
+	store.Get(ctx, "a")
+	store.Set(ctx, "c", []byte("3"), time.Minute) // evicts b as least recently used
+
+	v, err := store.Get(ctx, "a")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("1"), v)
+
+	v, err = store.Get(ctx, "b")
+	assert.NoError(t, err)
+	assert.Nil(t, v)
+
+	assert.NoError(t, store.Delete(ctx, "a"))
+	v, _ = store.Get(ctx, "a")
+	assert.Nil(t, v)
+	assert.Equal(t, 1, store.Len())
+}
+
+func TestValkeyCacheStore(t *testing.T) {
+	ctx := context.Background()
+	vp := assertvk.TestDB()
+	vc := vp.Get()
+	defer vc.Close()
+
+	defer assertvk.FlushDB()
+
+	store := httpx.NewValkeyCacheStore(vp, "test:http:")
+
+	// a missing key isn't an error
+	v, err := store.Get(ctx, "http://temba.io/")
+	assert.NoError(t, err)
+	assert.Nil(t, v)
+
+	assert.NoError(t, store.Set(ctx, "http://temba.io/", []byte("1"), time.Minute))
+
+	v, err = store.Get(ctx, "http://temba.io/")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("1"), v)
+
+	// values are stored under the key prefix with their TTL
+	stored, err := valkey.String(vc.Do("GET", "test:http:http://temba.io/"))
+	assert.NoError(t, err)
+	assert.Equal(t, "1", stored)
+
+	pttl, err := valkey.Int(vc.Do("PTTL", "test:http:http://temba.io/"))
+	assert.NoError(t, err)
+	assert.Greater(t, pttl, 59000)
+	assert.LessOrEqual(t, pttl, 60000)
+
+	assert.NoError(t, store.Delete(ctx, "http://temba.io/"))
+
+	v, err = store.Get(ctx, "http://temba.io/")
+	assert.NoError(t, err)
+	assert.Nil(t, v)
+
+	// it can be used as the store of a caching transport
+	mocks := httpx.WithMocks(nil, map[string][]*httpx.MockResponse{
+		"http://temba.io/*": {httpx.NewMockResponse(200, map[string]string{"Cache-Control": "max-age=60"}, []byte("hello"))},
+	})
+	transport := httpx.WithCache(mocks, store)
+
+	for range 2 {
+		request, err := httpx.NewRequest(ctx, "GET", "http://temba.io/", nil, nil)
+		assert.NoError(t, err)
+		_, err = transport.RoundTrip(request)
+		assert.NoError(t, err)
+	}
+	assert.False(t, mocks.HasUnused())
+
+	exists, err := valkey.Bool(vc.Do("EXISTS", "test:http:http://temba.io/"))
+	assert.NoError(t, err)
+	assert.True(t, exists)
+}
@@ -0,0 +1,193 @@
+package httpx
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/nyaruka/gocommon/jsonx"
+)
+
+// headers which aren't recorded on cassettes because they describe the original transfer rather than the response
+var cassetteSkipHeaders = []string{"Content-Length", "Transfer-Encoding", "Connection"}
+
+// Cassette is an http.RoundTripper which either records traffic to a JSON file, or replays traffic previously
+// recorded to that file. The file is a map of URLs to lists of mocked responses, in the same JSON format that's
+// used for WithMocks, so a recorded cassette can be checked in and edited by hand like any other mocks file. Bodies
+// are recorded as text, or as JSON where they're valid JSON, so binary bodies can't be faithfully recorded. It is
+// safe for concurrent use by multiple goroutines, as the http.RoundTripper contract requires.
+//
+// The mode is typically switched by a test flag, so that fixtures can be refreshed by re-running the tests with it:
+//
+//	var record = flag.Bool("record", false, "record HTTP cassettes")
+//
+//	cassette, err := httpx.NewCassette(nil, "testdata/foo.json", *record)
+//	client := &http.Client{Transport: cassette}
+//	...
+//	err = cassette.Save()
+//
+// To record traffic with a server whose URL changes on every run, e.g. an httptest server, pass CassetteBaseURL with
+// that URL when both recording and replaying.
+type Cassette struct {
+	path    string
+	record  bool
+	inner   http.RoundTripper
+	baseURL string
+	mocks   *MocksTransport // only used in replay mode
+
+	mutex    sync.Mutex // guards recorded and requests
+	recorded map[string][]*MockResponse
+	requests []*http.Request
+}
+
+// CassetteOption configures a cassette created with NewCassette.
+type CassetteOption func(*Cassette)
+
+// CassetteBaseURL makes a cassette record the URLs of requests to the given base URL relative to it, e.g. /foo
+// rather than http://127.0.0.1:54321/foo, and replay those relative URLs as requests to the given base URL.
+func CassetteBaseURL(base string) CassetteOption {
+	return func(c *Cassette) { c.baseURL = strings.TrimSuffix(base, "/") }
+}
+
+// NewCassette creates a new cassette for the given file. If record is true then requests are passed through to the
+// inner transport and their responses recorded, to be written to the file by Save. Otherwise the file is loaded and
+// requests are answered from it by a MocksTransport, with a request that wasn't recorded causing a panic. If inner
+// is nil then http.DefaultTransport is used.
+func NewCassette(inner http.RoundTripper, path string, record bool, opts ...CassetteOption) (*Cassette, error) {
+	if inner == nil {
+		inner = http.DefaultTransport
+	}
+
+	c := &Cassette{path: path, record: record, inner: inner}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	if record {
+		c.recorded = make(map[string][]*MockResponse)
+	} else {
+		mocks, err := LoadCassette(path)
+		if err != nil {
+			return nil, err
+		}
+
+		// resolve relative URLs against the base URL
+		resolved := make(map[string][]*MockResponse, len(mocks))
+		for url, ms := range mocks {
+			if strings.HasPrefix(url, "/") {
+				url = c.baseURL + url
+			}
+			resolved[url] = ms
+		}
+
+		c.mocks = WithMocks(inner, resolved)
+	}
+
+	return c, nil
+}
+
+// LoadCassette loads the mocked responses from the given cassette file, e.g. to pass to WithMocks
+func LoadCassette(path string) (map[string][]*MockResponse, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading cassette: %w", err)
+	}
+
+	mocks := make(map[string][]*MockResponse)
+	if err := json.Unmarshal(data, &mocks); err != nil {
+		return nil, fmt.Errorf("error unmarshaling cassette: %w", err)
+	}
+	return mocks, nil
+}
+
+func (c *Cassette) RoundTrip(request *http.Request) (*http.Response, error) {
+	if !c.record {
+		return c.mocks.RoundTrip(request)
+	}
+
+	response, err := c.inner.RoundTrip(request)
+	if err != nil {
+		c.add(request, MockConnectionError)
+		return nil, err
+	}
+
+	// read the full body so we can both record it and hand a readable copy back to the caller
+	body, err := io.ReadAll(response.Body)
+	response.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	response.Body = io.NopCloser(bytes.NewReader(body))
+
+	// record JSON bodies as JSON so that the cassette is easier to read and edit
+	mocked := NewMockResponse(response.StatusCode, nil, body)
+	mocked.Headers, mocked.MultiHeaders = mockHeaders(response.Header)
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') && json.Valid(trimmed) {
+		mocked.Body = trimmed
+		mocked.BodyIsString = false
+	}
+
+	c.add(request, mocked)
+
+	return response, nil
+}
+
+func (c *Cassette) add(request *http.Request, mocked *MockResponse) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	url := request.URL.String()
+	if rel, found := strings.CutPrefix(url, c.baseURL); c.baseURL != "" && found && (rel == "" || rel[0] == '/') {
+		url = "/" + strings.TrimPrefix(rel, "/")
+	}
+
+	c.recorded[url] = append(c.recorded[url], mocked)
+	c.requests = append(c.requests, request)
+}
+
+// Save writes the recorded responses to the cassette file. It does nothing when replaying.
+func (c *Cassette) Save() error {
+	if !c.record {
+		return nil
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	data, err := jsonx.MarshalPretty(c.recorded)
+	if err != nil {
+		return fmt.Errorf("error marshaling cassette: %w", err)
+	}
+	if err := os.WriteFile(c.path, data, 0644); err != nil {
+		return fmt.Errorf("error writing cassette: %w", err)
+	}
+	return nil
+}
+
+// Requests returns a snapshot of the requests that were recorded or replayed
+func (c *Cassette) Requests() []*http.Request {
+	if !c.record {
+		return c.mocks.Requests()
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return slices.Clone(c.requests)
+}
+
+// HasUnused returns true if replaying and there are recorded responses which haven't been used
+func (c *Cassette) HasUnused() bool {
+	if !c.record {
+		return c.mocks.HasUnused()
+	}
+	return false
+}
+
+var _ http.RoundTripper = (*Cassette)(nil)
@@ -0,0 +1,149 @@
+package httpx_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nyaruka/gocommon/httpx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCassette(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/json":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"id": 123}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("not found"))
+		}
+	}))
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "cassette.json")
+
+	get := func(client *http.Client, path string) (int, string) {
+		resp, err := client.Get(server.URL + path)
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(body)
+	}
+
+	// replaying a cassette which doesn't exist is an error
+	_, err := httpx.NewCassette(nil, path, false)
+	assert.ErrorContains(t, err, "error reading cassette")
+
+	// record some traffic
+	cassette, err := httpx.NewCassette(nil, path, true)
+	require.NoError(t, err)
+	client := &http.Client{Transport: cassette}
+
+	status, body := get(client, "/json")
+	assert.Equal(t, 200, status)
+	assert.Equal(t, `{"id": 123}`, body)
+	status, body = get(client, "/missing")
+	assert.Equal(t, 404, status)
+	assert.Equal(t, "not found", body)
+
+	assert.Len(t, cassette.Requests(), 2)
+	assert.False(t, cassette.HasUnused())
+	require.NoError(t, cassette.Save())
+
+	// recorded cassette uses the mocks format
+	mocks, err := httpx.LoadCassette(path)
+	require.NoError(t, err)
+	assert.Len(t, mocks, 2)
+	require.Len(t, mocks[server.URL+"/json"], 1)
+	assert.Equal(t, 200, mocks[server.URL+"/json"][0].Status)
+	assert.Equal(t, "application/json", mocks[server.URL+"/json"][0].Headers["Content-Type"])
+	assert.False(t, mocks[server.URL+"/json"][0].BodyIsString)
+	assert.NotContains(t, mocks[server.URL+"/json"][0].Headers, "Content-Length")
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.True(t, strings.Contains(string(data), `"body": "not found"`))
+
+	// replay it without the server
+	server.Close()
+
+	cassette, err = httpx.NewCassette(nil, path, false)
+	require.NoError(t, err)
+	client = &http.Client{Transport: cassette}
+
+	status, body = get(client, "/json")
+	assert.Equal(t, 200, status)
+	assert.JSONEq(t, `{"id": 123}`, body)
+	assert.True(t, cassette.HasUnused())
+
+	status, body = get(client, "/missing")
+	assert.Equal(t, 404, status)
+	assert.Equal(t, "not found", body)
+	assert.False(t, cassette.HasUnused())
+	assert.Len(t, cassette.Requests(), 2)
+	assert.NoError(t, cassette.Save()) // no-op when replaying
+
+	// connection errors are recorded too
+	cassette, err = httpx.NewCassette(nil, path, true)
+	require.NoError(t, err)
+	_, err = (&http.Client{Transport: cassette}).Get(server.URL + "/json")
+	assert.Error(t, err)
+	require.NoError(t, cassette.Save())
+
+	mocks, err = httpx.LoadCassette(path)
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]*httpx.MockResponse{server.URL + "/json": {httpx.MockConnectionError}}, mocks)
+}
+
+func TestCassetteBaseURL(t *testing.T) {
+	newServer := func() *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Set-Cookie", "a=1")
+			w.Header().Add("Set-Cookie", "b=2")
+			w.Write([]byte("hello"))
+		}))
+	}
+
+	path := filepath.Join(t.TempDir(), "cassette.json")
+
+	// record traffic to a server, which gets a different port every time
+	server := newServer()
+	cassette, err := httpx.NewCassette(nil, path, true, httpx.CassetteBaseURL(server.URL))
+	require.NoError(t, err)
+	client := &http.Client{Transport: cassette}
+
+	resp, err := client.Get(server.URL + "/hello?x=1")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a=1", "b=2"}, resp.Header.Values("Set-Cookie"))
+	require.NoError(t, cassette.Save())
+	server.Close()
+
+	// URLs are recorded relative to the base URL, and all values of headers are kept
+	mocks, err := httpx.LoadCassette(path)
+	require.NoError(t, err)
+	require.Len(t, mocks["/hello?x=1"], 1)
+	assert.Equal(t, map[string][]string{"Set-Cookie": {"a=1", "b=2"}}, mocks["/hello?x=1"][0].MultiHeaders)
+	assert.NotContains(t, mocks["/hello?x=1"][0].Headers, "Set-Cookie")
+
+	// so they can be replayed against a server with a different URL
+	server = newServer()
+	defer server.Close()
+
+	cassette, err = httpx.NewCassette(nil, path, false, httpx.CassetteBaseURL(server.URL))
+	require.NoError(t, err)
+	client = &http.Client{Transport: cassette}
+
+	resp, err = client.Get(server.URL + "/hello?x=1")
+	require.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, "hello", string(body))
+	assert.Equal(t, []string{"a=1", "b=2"}, resp.Header.Values("Set-Cookie"))
+	assert.False(t, cassette.HasUnused())
+}
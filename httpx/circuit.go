@@ -0,0 +1,186 @@
+package httpx
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/nyaruka/gocommon/dates"
+)
+
+// CircuitOpenError is returned when a request is refused without being sent because the circuit for its host is open
+type CircuitOpenError struct {
+	Host    string
+	RetryAt time.Time // when the circuit will next allow a trial request
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrCircuitOpen.Error(), e.Host)
+}
+
+// Unwrap allows errors.Is(err, ErrCircuitOpen) to match any circuit open error
+func (e *CircuitOpenError) Unwrap() error {
+	return ErrCircuitOpen
+}
+
+// CircuitBreakerConfig configures when the circuit for a host opens and how long it stays open
+type CircuitBreakerConfig struct {
+	Threshold int                                             // number of consecutive failures which opens the circuit
+	Cooldown  time.Duration                                   // how long an open circuit refuses requests before allowing a trial request
+	IsFailure func(*http.Request, *http.Response, error) bool // if nil, DefaultIsFailure is used
+}
+
+// NewCircuitBreakerConfig creates a new circuit breaker config with the given threshold and cooldown
+func NewCircuitBreakerConfig(threshold int, cooldown time.Duration) *CircuitBreakerConfig {
+	return &CircuitBreakerConfig{Threshold: threshold, Cooldown: cooldown, IsFailure: DefaultIsFailure}
+}
+
+// DefaultIsFailure is the default function for determining if a request failed in a way that counts against its
+// host's circuit, i.e. it couldn't get a response, or the response was a 429 or 5XX. A request which failed because
+// its own context was cancelled isn't the host's fault, so doesn't count.
+func DefaultIsFailure(request *http.Request, response *http.Response, err error) bool {
+	if err != nil {
+		return request.Context().Err() == nil
+	}
+	return response.StatusCode == http.StatusTooManyRequests || response.StatusCode >= 500
+}
+
+// outcome is how a request affects the circuit for its host
+type outcome int
+
+const (
+	outcomeSuccess outcome = iota
+	outcomeFailure
+	outcomeIgnored // e.g. the request was cancelled by its caller so says nothing about the host
+)
+
+// circuit is the state of the circuit for a single host
+type circuit struct {
+	failures int       // consecutive failures
+	openedAt time.Time // zero if closed
+	trialing bool      // whether a trial request is in flight while half-open
+}
+
+// circuitBreakerTransport is an http.RoundTripper which tracks failures per host and refuses requests to hosts which
+// are failing, delegating to an inner transport. It is safe for concurrent use by multiple goroutines, as the
+// http.RoundTripper contract requires.
+type circuitBreakerTransport struct {
+	inner    http.RoundTripper
+	config   *CircuitBreakerConfig
+	mutex    sync.Mutex // guards circuits
+	circuits map[string]*circuit
+}
+
+// WithCircuitBreaker wraps an http.RoundTripper so that requests to a host fail fast with a *CircuitOpenError once
+// that host has failed config.Threshold times in a row. After config.Cooldown the circuit becomes half-open and lets
+// a single trial request through - if that succeeds the circuit closes again, and if it fails the circuit re-opens
+// for another cooldown. A nil config makes it a pass-through, so it's always safe to wrap. If inner is nil then
+// http.DefaultTransport is used.
+//
+// Hosts are tracked by the transport, so share a single transport between all the clients which call the same
+// hosts. Compose this inside WithTraces and a refused request is still traced, with Trace.CircuitOpen set. Compose
+// it outside WithRetries so that a request counts as a single failure however many retries it took:
+//
+//	httpx.WithTraces(httpx.WithCircuitBreaker(httpx.WithRetries(inner, retries), breaker))
+func WithCircuitBreaker(inner http.RoundTripper, config *CircuitBreakerConfig) http.RoundTripper {
+	if inner == nil {
+		inner = http.DefaultTransport
+	}
+	return &circuitBreakerTransport{inner: inner, config: config, circuits: make(map[string]*circuit)}
+}
+
+func (t *circuitBreakerTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	if t.config == nil {
+		return t.inner.RoundTrip(request)
+	}
+
+	host := request.URL.Host
+
+	if err := t.acquire(host); err != nil {
+		if stats := traceStatsFromContext(request.Context()); stats != nil {
+			stats.circuitOpen.Store(true)
+		}
+
+		// the http.RoundTripper contract requires the request body to be closed even on error paths
+		if request.Body != nil {
+			request.Body.Close()
+		}
+		return nil, err
+	}
+
+	response, err := t.inner.RoundTrip(request)
+
+	isFailure := t.config.IsFailure
+	if isFailure == nil {
+		isFailure = DefaultIsFailure
+	}
+
+	o := outcomeSuccess
+	if err != nil && request.Context().Err() != nil {
+		o = outcomeIgnored
+	} else if isFailure(request, response, err) {
+		o = outcomeFailure
+	}
+
+	t.release(host, o)
+
+	return response, err
+}
+
+// acquire checks whether a request can be made to the given host, returning a *CircuitOpenError if not
+func (t *circuitBreakerTransport) acquire(host string) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	c := t.circuits[host]
+	if c == nil || c.openedAt.IsZero() {
+		return nil
+	}
+
+	retryAt := c.openedAt.Add(t.config.Cooldown)
+
+	// still cooling down, or half-open but with a trial request already in flight
+	if dates.Now().Before(retryAt) || c.trialing {
+		return &CircuitOpenError{Host: host, RetryAt: retryAt}
+	}
+
+	c.trialing = true
+	return nil
+}
+
+// release records the outcome of a request made to the given host
+func (t *circuitBreakerTransport) release(host string, o outcome) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	c := t.circuits[host]
+
+	switch o {
+	case outcomeSuccess:
+		// a success closes the circuit and we no longer need to track the host
+		delete(t.circuits, host)
+		return
+	case outcomeIgnored:
+		// leave the counts alone, but if this was a trial then let another one through
+		if c != nil {
+			c.trialing = false
+		}
+		return
+	}
+
+	if c == nil {
+		c = &circuit{}
+		t.circuits[host] = c
+	}
+
+	c.failures++
+
+	// a failed trial re-opens the circuit, as does reaching the threshold
+	if c.trialing || c.failures >= t.config.Threshold {
+		c.openedAt = dates.Now()
+		c.trialing = false
+	}
+}
+
+var _ http.RoundTripper = (*circuitBreakerTransport)(nil)
@@ -0,0 +1,166 @@
+package httpx_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/nyaruka/gocommon/dates"
+	"github.com/nyaruka/gocommon/httpx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithCircuitBreaker(t *testing.T) {
+	ctx := context.Background()
+
+	now := time.Date(2019, 10, 7, 15, 21, 30, 0, time.UTC)
+	defer dates.SetNowFunc(time.Now)
+	dates.SetNowFunc(func() time.Time { return now })
+
+	inner := &recordingTransport{steps: []recordedStep{
+		{status: 200, body: "ok"},
+		{status: 503, body: "fail"},
+		{status: 0},
+		{status: 200, body: "other host"},
+		{status: 503, body: "fail"},
+		{status: 503, body: "trial fails"},
+		{status: 200, body: "trial ok"},
+		{status: 200, body: "ok"},
+	}}
+	breaker := httpx.WithCircuitBreaker(inner, httpx.NewCircuitBreakerConfig(3, time.Minute))
+
+	call := func(url string) (int, error) {
+		req, err := httpx.NewRequest(ctx, "GET", url, nil, nil)
+		require.NoError(t, err)
+		resp, err := breaker.RoundTrip(req)
+		if err != nil {
+			return 0, err
+		}
+		return resp.StatusCode, nil
+	}
+
+	status, err := call("http://temba.io/")
+	assert.NoError(t, err)
+	assert.Equal(t, 200, status)
+
+	// two failures aren't enough to open the circuit, and failures on another host don't count
+	status, _ = call("http://temba.io/")
+	assert.Equal(t, 503, status)
+	_, err = call("http://temba.io/")
+	assert.EqualError(t, err, "unable to connect to server")
+	status, _ = call("http://nyaruka.com/")
+	assert.Equal(t, 200, status)
+
+	// but three are
+	status, _ = call("http://temba.io/")
+	assert.Equal(t, 503, status)
+	assert.Equal(t, 5, inner.calls)
+
+	// and now requests to that host fail fast without being sent
+	_, err = call("http://temba.io/")
+	assert.ErrorIs(t, err, httpx.ErrCircuitOpen)
+	assert.EqualError(t, err, "circuit open for host: temba.io")
+
+	var openErr *httpx.CircuitOpenError
+	require.ErrorAs(t, err, &openErr)
+	assert.Equal(t, "temba.io", openErr.Host)
+	assert.Equal(t, now.Add(time.Minute), openErr.RetryAt)
+	assert.Equal(t, 5, inner.calls)
+
+	// after the cooldown a trial request is let through, and if that fails the circuit re-opens
+	now = now.Add(time.Minute)
+	status, _ = call("http://temba.io/")
+	assert.Equal(t, 503, status)
+	_, err = call("http://temba.io/")
+	assert.ErrorIs(t, err, httpx.ErrCircuitOpen)
+	assert.Equal(t, 6, inner.calls)
+
+	// if the next trial succeeds the circuit closes
+	now = now.Add(time.Minute)
+	status, _ = call("http://temba.io/")
+	assert.Equal(t, 200, status)
+	status, _ = call("http://temba.io/")
+	assert.Equal(t, 200, status)
+	assert.Equal(t, 8, inner.calls)
+
+	// a nil config is a pass-through
+	inner = &recordingTransport{steps: []recordedStep{{status: 0}, {status: 0}}}
+	breaker = httpx.WithCircuitBreaker(inner, nil)
+	for range 2 {
+		_, err = call("http://temba.io/")
+		assert.EqualError(t, err, "unable to connect to server")
+	}
+}
+
+func TestWithCircuitBreakerAndTraces(t *testing.T) {
+	ctx := context.Background()
+
+	inner := &recordingTransport{steps: []recordedStep{{status: 0}}}
+	transport := httpx.WithTraces(httpx.WithCircuitBreaker(inner, httpx.NewCircuitBreakerConfig(1, time.Minute)))
+
+	for range 2 {
+		traceCtx, traces := httpx.WithTraceCollector(ctx)
+		req, err := httpx.NewRequest(traceCtx, "GET", "http://temba.io/", nil, nil)
+		require.NoError(t, err)
+		_, err = transport.RoundTrip(req)
+		assert.Error(t, err)
+		require.Len(t, traces.Traces(), 1)
+
+		// only the refused request is recorded as such
+		trace := traces.Last()
+		assert.Equal(t, errors.Is(err, httpx.ErrCircuitOpen), trace.CircuitOpen)
+		assert.Nil(t, trace.Response)
+	}
+
+	assert.Equal(t, 1, inner.calls)
+
+	// a request which fails because its own context was cancelled doesn't count against the host
+	inner = &recordingTransport{steps: []recordedStep{{status: 0}, {status: 200}}}
+	transport = httpx.WithCircuitBreaker(inner, httpx.NewCircuitBreakerConfig(1, time.Minute))
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	req, _ := httpx.NewRequest(cancelled, "GET", "http://temba.io/", nil, nil)
+	_, err := transport.RoundTrip(req)
+	assert.EqualError(t, err, "unable to connect to server")
+
+	req, _ = httpx.NewRequest(ctx, "GET", "http://temba.io/", nil, nil)
+	resp, err := transport.RoundTrip(req)
+	require.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+}
+
+func TestWithCircuitBreakerCancelled(t *testing.T) {
+	ctx := context.Background()
+
+	now := time.Date(2019, 10, 7, 15, 21, 30, 0, time.UTC)
+	defer dates.SetNowFunc(time.Now)
+	dates.SetNowFunc(func() time.Time { return now })
+
+	// a struct literal config without IsFailure uses the default
+	inner := &recordingTransport{steps: []recordedStep{{status: 503}, {status: 0}, {status: 503}, {status: 0}, {status: 503}}}
+	transport := httpx.WithCircuitBreaker(inner, &httpx.CircuitBreakerConfig{Threshold: 2, Cooldown: time.Minute})
+
+	call := func(ctx context.Context) error {
+		req, _ := httpx.NewRequest(ctx, "GET", "http://temba.io/", nil, nil)
+		_, err := transport.RoundTrip(req)
+		return err
+	}
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+
+	// a cancelled request doesn't reset the count of consecutive failures
+	assert.NoError(t, call(ctx))
+	assert.EqualError(t, call(cancelled), "unable to connect to server")
+	assert.NoError(t, call(ctx))
+	assert.ErrorIs(t, call(ctx), httpx.ErrCircuitOpen)
+	assert.Equal(t, 3, inner.calls)
+
+	// a cancelled trial doesn't close the circuit, but does let another trial through, which re-opens it if it fails
+	now = now.Add(time.Minute)
+	assert.EqualError(t, call(cancelled), "unable to connect to server")
+	assert.NoError(t, call(ctx))
+	assert.ErrorIs(t, call(ctx), httpx.ErrCircuitOpen)
+	assert.Equal(t, 5, inner.calls)
+}
@@ -0,0 +1,87 @@
+package httpx
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+)
+
+// maxDecodedBody is the most we'll decode of an encoded body, which guards against a small compressed body which
+// expands into something huge
+const maxDecodedBody = 1 << 20 // 1MB
+
+// ContentDecoder creates a reader which decodes a body with a particular content encoding
+type ContentDecoder func(io.Reader) (io.Reader, error)
+
+var contentDecodersMutex sync.RWMutex
+var contentDecoders = map[string]ContentDecoder{
+	"gzip":    func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+	"x-gzip":  func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+	"deflate": func(r io.Reader) (io.Reader, error) { return zlib.NewReader(r) },
+	"br":      func(r io.Reader) (io.Reader, error) { return brotli.NewReader(r), nil },
+}
+
+// RegisterContentDecoder registers a decoder for a content encoding, in addition to the gzip, deflate and brotli
+// decoders which are built in. For example, zstd can be added with:
+//
+//	httpx.RegisterContentDecoder("zstd", func(r io.Reader) (io.Reader, error) { return zstd.NewReader(r) })
+func RegisterContentDecoder(encoding string, decoder ContentDecoder) {
+	contentDecodersMutex.Lock()
+	defer contentDecodersMutex.Unlock()
+
+	contentDecoders[strings.ToLower(encoding)] = decoder
+}
+
+// DecodeContent decodes the given body according to the given Content-Encoding header value, which may list several
+// encodings in the order they were applied. Decoding stops at maxDecodedBody bytes, and a body which was truncated,
+// e.g. by a trace capture limit, is decoded as far as possible.
+func DecodeContent(body []byte, contentEncoding string) ([]byte, error) {
+	encodings := strings.Split(contentEncoding, ",")
+
+	// encodings are listed in the order they were applied so must be undone in reverse
+	for i := len(encodings) - 1; i >= 0; i-- {
+		encoding := strings.ToLower(strings.TrimSpace(encodings[i]))
+		if encoding == "" || encoding == "identity" {
+			continue
+		}
+
+		contentDecodersMutex.RLock()
+		decoder := contentDecoders[encoding]
+		contentDecodersMutex.RUnlock()
+
+		if decoder == nil {
+			return nil, fmt.Errorf("unsupported content encoding: %s", encoding)
+		}
+
+		r, err := decoder(bytes.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("error decoding %s content: %w", encoding, err)
+		}
+
+		decoded, err := io.ReadAll(io.LimitReader(r, maxDecodedBody))
+		if err != nil && !(errors.Is(err, io.ErrUnexpectedEOF) && len(decoded) > 0) {
+			return nil, fmt.Errorf("error decoding %s content: %w", encoding, err)
+		}
+		body = decoded
+	}
+	return body, nil
+}
+
+// decodedBody returns the given body decoded according to the Content-Encoding in the given header, or the body as
+// is if it isn't encoded or can't be decoded.
+func decodedBody(body []byte, header http.Header) []byte {
+	if encoding := header.Get("Content-Encoding"); encoding != "" && len(body) > 0 {
+		if decoded, err := DecodeContent(body, encoding); err == nil {
+			return decoded
+		}
+	}
+	return body
+}
@@ -0,0 +1,254 @@
+package httpx
+
+import (
+	"bytes"
+	"encoding/base64"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"time"
+	"unicode/utf8"
+
+	"github.com/nyaruka/gocommon/stringsx"
+)
+
+// HAR is an HTTP Archive (see http://www.softwareishard.com/blog/har-12-spec/) which can be marshaled to JSON and
+// opened in browser devtools or other HAR viewers.
+type HAR struct {
+	Log *HARLog `json:"log"`
+}
+
+type HARLog struct {
+	Version string      `json:"version"`
+	Creator *HARCreator `json:"creator"`
+	Entries []*HAREntry `json:"entries"`
+}
+
+type HARCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+// HAREntry is a single request/response in a HAR. Retries is a custom field as allowed by the spec.
+type HAREntry struct {
+	StartedDateTime time.Time    `json:"startedDateTime"`
+	Time            float64      `json:"time"`
+	Request         *HARRequest  `json:"request"`
+	Response        *HARResponse `json:"response"`
+	Cache           struct{}     `json:"cache"`
+	Timings         *HARTimings  `json:"timings"`
+	Retries         int          `json:"_retries"`
+}
+
+type HARRequest struct {
+	Method      string          `json:"method"`
+	URL         string          `json:"url"`
+	HTTPVersion string          `json:"httpVersion"`
+	Cookies     []*HARNameValue `json:"cookies"`
+	Headers     []*HARNameValue `json:"headers"`
+	QueryString []*HARNameValue `json:"queryString"`
+	PostData    *HARPostData    `json:"postData,omitempty"`
+	HeadersSize int             `json:"headersSize"`
+	BodySize    int             `json:"bodySize"`
+}
+
+type HARResponse struct {
+	Status      int             `json:"status"`
+	StatusText  string          `json:"statusText"`
+	HTTPVersion string          `json:"httpVersion"`
+	Cookies     []*HARNameValue `json:"cookies"`
+	Headers     []*HARNameValue `json:"headers"`
+	Content     *HARContent     `json:"content"`
+	RedirectURL string          `json:"redirectURL"`
+	HeadersSize int             `json:"headersSize"`
+	BodySize    int             `json:"bodySize"`
+}
+
+type HARNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type HARPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type HARContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+// HARTimings are the times in milliseconds spent in each phase of a request, with -1 for phases which don't apply
+type HARTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+	SSL     float64 `json:"ssl"`
+}
+
+// NewHAR creates a new HTTP Archive from the given traces, applying the given redactor (which may be nil) to URLs,
+// headers, cookies and bodies.
+func NewHAR(traces []*Trace, redact stringsx.Redactor) *HAR {
+	if redact == nil {
+		redact = func(s string) string { return s }
+	}
+
+	entries := make([]*HAREntry, len(traces))
+	for i, t := range traces {
+		entries[i] = newHAREntry(t, redact)
+	}
+
+	return &HAR{Log: &HARLog{
+		Version: "1.2",
+		Creator: &HARCreator{Name: "github.com/nyaruka/gocommon/httpx", Version: "1.0"},
+		Entries: entries,
+	}}
+}
+
+// HAR creates a new HTTP Archive from the traces collected so far
+func (c *TraceCollector) HAR(redact stringsx.Redactor) *HAR {
+	return NewHAR(c.Traces(), redact)
+}
+
+func newHAREntry(t *Trace, redact stringsx.Redactor) *HAREntry {
+	elapsed := toMS(t.EndTime.Sub(t.StartTime))
+
+	return &HAREntry{
+		StartedDateTime: t.StartTime,
+		Time:            elapsed,
+		Request:         newHARRequest(t, redact),
+		Response:        newHARResponse(t, redact),
+		Timings:         newHARTimings(t, elapsed),
+		Retries:         t.Retries,
+	}
+}
+
+func newHARTimings(t *Trace, elapsed float64) *HARTimings {
+	timings := &HARTimings{Blocked: -1, DNS: -1, Connect: -1, Wait: elapsed, SSL: -1}
+
+	if t.Timings != nil {
+		if !t.Timings.ConnReused {
+			// in a HAR the connect time includes the SSL time
+			timings.DNS = toMS(t.Timings.DNS)
+			timings.Connect = toMS(t.Timings.Connect + t.Timings.TLS)
+			if t.Timings.TLS > 0 {
+				timings.SSL = toMS(t.Timings.TLS)
+			}
+		}
+		timings.Wait = max(toMS(t.Timings.FirstByte-t.Timings.DNS-t.Timings.Connect-t.Timings.TLS), 0)
+		timings.Receive = max(elapsed-toMS(t.Timings.FirstByte), 0)
+	}
+	return timings
+}
+
+func newHARRequest(t *Trace, redact stringsx.Redactor) *HARRequest {
+	headers, wireBody := splitTrace(t.RequestTrace)
+
+	r := &HARRequest{
+		Method:      t.Request.Method,
+		URL:         redact(t.Request.URL.String()),
+		HTTPVersion: "HTTP/1.1",
+		Cookies:     []*HARNameValue{},
+		Headers:     []*HARNameValue{},
+		QueryString: harValues(t.Request.URL.Query(), redact),
+		HeadersSize: len(headers),
+		BodySize:    len(wireBody),
+	}
+	if t.Request.Proto != "" {
+		r.HTTPVersion = t.Request.Proto
+	}
+
+	// read the headers back from the trace as that's what was actually sent, rather than the request object which
+	// won't include headers added by the transport such as User-Agent, and the body without any chunked framing
+	var body []byte
+	if parsed, parsedBody, err := readRequestTrace(t.RequestTrace); err == nil {
+		r.Headers = harHeaders(parsed.Header, redact)
+		r.Cookies = harCookies(parsed.Cookies(), redact)
+		body = parsedBody
+	}
+
+	if len(body) > 0 {
+		text, _ := harText(body, redact)
+		r.PostData = &HARPostData{MimeType: t.Request.Header.Get("Content-Type"), Text: text}
+	}
+	return r
+}
+
+func newHARResponse(t *Trace, redact stringsx.Redactor) *HARResponse {
+	r := &HARResponse{
+		Cookies: []*HARNameValue{},
+		Headers: []*HARNameValue{},
+		Content: &HARContent{},
+	}
+
+	// a request which didn't get a response is recorded with a zero status as browsers do
+	if t.Response == nil {
+		return r
+	}
+
+	r.Status = t.Response.StatusCode
+	r.StatusText = http.StatusText(t.Response.StatusCode)
+	r.HTTPVersion = t.Response.Proto
+	r.Cookies = harCookies(t.Response.Cookies(), redact)
+	r.Headers = harHeaders(t.Response.Header, redact)
+	r.RedirectURL = redact(t.Response.Header.Get("Location"))
+	r.HeadersSize = len(t.ResponseTrace)
+	r.BodySize = t.ResponseSize() - len(t.ResponseTrace)
+
+	// content is described as decoded, whereas the body size is what was sent over the wire
+	content := decodedBody(t.ResponseBody, t.Response.Header)
+	r.Content.Size = r.BodySize + len(content) - len(t.ResponseBody)
+	r.Content.MimeType = t.Response.Header.Get("Content-Type")
+	r.Content.Text, r.Content.Encoding = harText(content, redact)
+	return r
+}
+
+// splitTrace splits a raw request or response trace into its headers and body
+func splitTrace(trace []byte) ([]byte, []byte) {
+	headers, body, found := bytes.Cut(trace, []byte("\r\n\r\n"))
+	if !found {
+		return trace, nil
+	}
+	return append(headers, "\r\n\r\n"...), body
+}
+
+// harText returns the given body as text if it's valid UTF-8, or base64 encoded if not
+func harText(body []byte, redact stringsx.Redactor) (string, string) {
+	if utf8.Valid(body) {
+		return redact(string(body)), ""
+	}
+	return base64.StdEncoding.EncodeToString(body), "base64"
+}
+
+func harHeaders(header http.Header, redact stringsx.Redactor) []*HARNameValue {
+	nvs := []*HARNameValue{}
+	for _, k := range slices.Sorted(maps.Keys(header)) {
+		for _, v := range header[k] {
+			nvs = append(nvs, &HARNameValue{Name: k, Value: redact(v)})
+		}
+	}
+	return nvs
+}
+
+func harValues(values url.Values, redact stringsx.Redactor) []*HARNameValue {
+	return harHeaders(http.Header(values), redact)
+}
+
+func harCookies(cookies []*http.Cookie, redact stringsx.Redactor) []*HARNameValue {
+	nvs := make([]*HARNameValue, len(cookies))
+	for i, c := range cookies {
+		nvs[i] = &HARNameValue{Name: c.Name, Value: redact(c.Value)}
+	}
+	return nvs
+}
+
+func toMS(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
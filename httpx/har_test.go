@@ -0,0 +1,115 @@
+package httpx_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nyaruka/gocommon/dates"
+	"github.com/nyaruka/gocommon/httpx"
+	"github.com/nyaruka/gocommon/jsonx"
+	"github.com/nyaruka/gocommon/stringsx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHAR(t *testing.T) {
+	defer dates.SetNowFunc(time.Now)
+	dates.SetNowFunc(dates.NewSequentialNow(time.Date(2019, 10, 7, 15, 21, 30, 0, time.UTC), time.Second))
+
+	tt := httpx.WithTraces(httpx.WithMocks(nil, map[string][]*httpx.MockResponse{
+		"http://temba.io/send?token=sesame": {
+			httpx.NewMockResponse(200, map[string]string{"Content-Type": "application/json", "Set-Cookie": "session=sesame"}, []byte(`{"secret": "sesame"}`)),
+		},
+		"http://temba.io/image.png": {
+			httpx.NewMockResponse(200, map[string]string{"Content-Type": "image/png"}, []byte{0x89, 0x50, 0x4e, 0x47, 0xff}),
+		},
+		"http://temba.io/down": {httpx.MockConnectionError},
+	}))
+
+	ctx, traces := httpx.WithTraceCollector(context.Background())
+
+	req, err := httpx.NewRequest(ctx, "POST", "http://temba.io/send?token=sesame", strings.NewReader(`{"password": "sesame"}`), map[string]string{"Content-Type": "application/json", "Authorization": "Token sesame"})
+	require.NoError(t, err)
+	_, err = tt.RoundTrip(req)
+	require.NoError(t, err)
+
+	req, _ = httpx.NewRequest(ctx, "GET", "http://temba.io/image.png", nil, nil)
+	_, err = tt.RoundTrip(req)
+	require.NoError(t, err)
+
+	req, _ = httpx.NewRequest(ctx, "GET", "http://temba.io/down", nil, nil)
+	_, err = tt.RoundTrip(req)
+	require.Error(t, err)
+
+	har := traces.HAR(stringsx.NewRedactor("****", "sesame"))
+	assert.Equal(t, "1.2", har.Log.Version)
+	require.Len(t, har.Log.Entries, 3)
+
+	e1 := har.Log.Entries[0]
+	assert.Equal(t, time.Date(2019, 10, 7, 15, 21, 30, 0, time.UTC), e1.StartedDateTime)
+	assert.Equal(t, float64(1000), e1.Time)
+	assert.Equal(t, "POST", e1.Request.Method)
+	assert.Equal(t, "http://temba.io/send?token=****", e1.Request.URL)
+	assert.Equal(t, []*httpx.HARNameValue{{Name: "token", Value: "****"}}, e1.Request.QueryString)
+	assert.Contains(t, e1.Request.Headers, &httpx.HARNameValue{Name: "Authorization", Value: "Token ****"})
+	assert.Contains(t, e1.Request.Headers, &httpx.HARNameValue{Name: "User-Agent", Value: "Go-http-client/1.1"})
+	assert.Equal(t, &httpx.HARPostData{MimeType: "application/json", Text: `{"password": "****"}`}, e1.Request.PostData)
+	assert.Equal(t, 22, e1.Request.BodySize)
+	assert.Equal(t, 200, e1.Response.Status)
+	assert.Equal(t, "OK", e1.Response.StatusText)
+	assert.Equal(t, []*httpx.HARNameValue{{Name: "session", Value: "****"}}, e1.Response.Cookies)
+	assert.Equal(t, &httpx.HARContent{Size: 20, MimeType: "application/json", Text: `{"secret": "****"}`}, e1.Response.Content)
+	assert.Equal(t, float64(1000), e1.Timings.Wait)
+
+	// binary bodies are base64 encoded
+	e2 := har.Log.Entries[1]
+	assert.Nil(t, e2.Request.PostData)
+	assert.Equal(t, &httpx.HARContent{Size: 5, MimeType: "image/png", Text: "iVBOR/8=", Encoding: "base64"}, e2.Response.Content)
+
+	// requests without responses have a zero status
+	e3 := har.Log.Entries[2]
+	assert.Equal(t, 0, e3.Response.Status)
+	assert.Equal(t, []*httpx.HARNameValue{}, e3.Response.Headers)
+
+	// and the whole thing can be marshaled to JSON
+	marshaled, err := jsonx.Marshal(httpx.NewHAR(traces.Traces()[2:], nil))
+	require.NoError(t, err)
+	assert.JSONEq(t, `{
+		"log": {
+			"version": "1.2",
+			"creator": {"name": "github.com/nyaruka/gocommon/httpx", "version": "1.0"},
+			"entries": [
+				{
+					"startedDateTime": "2019-10-07T15:21:34Z",
+					"time": 1000,
+					"request": {
+						"method": "GET",
+						"url": "http://temba.io/down",
+						"httpVersion": "HTTP/1.1",
+						"cookies": [],
+						"headers": [{"name": "Accept-Encoding", "value": "gzip"}, {"name": "User-Agent", "value": "Go-http-client/1.1"}],
+						"queryString": [],
+						"headersSize": 93,
+						"bodySize": 0
+					},
+					"response": {
+						"status": 0,
+						"statusText": "",
+						"httpVersion": "",
+						"cookies": [],
+						"headers": [],
+						"content": {"size": 0, "mimeType": ""},
+						"redirectURL": "",
+						"headersSize": 0,
+						"bodySize": 0
+					},
+					"cache": {},
+					"timings": {"blocked": -1, "dns": -1, "connect": -1, "send": 0, "wait": 1000, "receive": 0, "ssl": -1},
+					"_retries": 0
+				}
+			]
+		}
+	}`, string(marshaled))
+}
@@ -0,0 +1,200 @@
+package httpx
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	hedgingWindow     = 100 // number of recent latencies kept for calculating a percentile delay
+	hedgingMinSamples = 20  // number of latencies needed before a percentile delay is used
+)
+
+// HedgingConfig configures when a hedged request is sent
+type HedgingConfig struct {
+	Delay      time.Duration // how long to wait for a response before hedging, until there are enough latency samples
+	Percentile float64       // if non-zero, hedge requests which take longer than this percentile (0-1) of recent ones
+}
+
+// NewHedgingConfig creates a new hedging config which hedges requests that take longer than the given percentile of
+// recent requests, or the given delay until there have been enough requests to calculate that. A zero percentile
+// always uses the given delay, and the percentile is clamped to between 0 and 1.
+func NewHedgingConfig(delay time.Duration, percentile float64) *HedgingConfig {
+	return &HedgingConfig{Delay: delay, Percentile: min(max(percentile, 0), 1)}
+}
+
+// hedgingTransport is an http.RoundTripper which sends a second attempt of a slow idempotent request, delegating
+// both attempts to an inner transport. It is safe for concurrent use by multiple goroutines, as the
+// http.RoundTripper contract requires.
+type hedgingTransport struct {
+	inner  http.RoundTripper
+	config *HedgingConfig
+
+	mutex     sync.Mutex // guards latencies
+	latencies []time.Duration
+}
+
+// WithHedging wraps an http.RoundTripper so that if an idempotent request, e.g. a GET or a POST with an Idempotency-Key
+// header, hasn't had a response within the hedging delay, a second attempt is sent alongside it. Whichever attempt gets
+// a response first wins, and the other is cancelled. If the first attempt fails before the delay, its error is returned
+// without hedging, as recovering from failures is the job of WithRetries. A request with a body is only hedged if the
+// body can be rewound, as for retries. A nil config makes it a pass-through, so it's always safe to wrap. If inner is
+// nil then http.DefaultTransport is used.
+//
+// Latencies for a percentile delay are tracked by the transport, so share a single transport between the clients
+// which call the same API. Compose this inside WithTraces and a hedged request is counted in Trace.Retries, and
+// outside WithRetries so that each attempt can itself be retried:
+//
+//	httpx.WithTraces(httpx.WithHedging(httpx.WithRetries(inner, retries), hedging))
+func WithHedging(inner http.RoundTripper, config *HedgingConfig) http.RoundTripper {
+	if inner == nil {
+		inner = http.DefaultTransport
+	}
+	return &hedgingTransport{inner: inner, config: config}
+}
+
+// hedgeResult is the outcome of a single attempt
+type hedgeResult struct {
+	response *http.Response
+	err      error
+	elapsed  time.Duration
+	attempt  int
+}
+
+func (t *hedgingTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	if t.config == nil || !isIdempotent(request) || (request.Body != nil && request.Body != http.NoBody && request.GetBody == nil) {
+		return t.inner.RoundTrip(request)
+	}
+
+	stats := traceStatsFromContext(request.Context())
+	results := make(chan *hedgeResult, 2)
+	var cancels []context.CancelFunc
+
+	send := func(req *http.Request) {
+		ctx, cancel := context.WithCancel(request.Context())
+		attempt := len(cancels)
+		cancels = append(cancels, cancel)
+		start := time.Now()
+
+		go func() {
+			response, err := t.inner.RoundTrip(req.WithContext(ctx))
+			results <- &hedgeResult{response: response, err: err, elapsed: time.Since(start), attempt: attempt}
+		}()
+	}
+
+	send(request)
+	inFlight := 1
+
+	timer := time.NewTimer(t.delay())
+	defer timer.Stop()
+	hedge := timer.C
+
+	for {
+		select {
+		case <-hedge:
+			hedge = nil
+
+			// the hedge needs its own copy of the body
+			hedged := request.Clone(request.Context())
+			if request.Body != nil && request.Body != http.NoBody {
+				body, err := request.GetBody()
+				if err != nil {
+					continue // carry on waiting for the first attempt
+				}
+				hedged.Body = body
+			}
+
+			send(hedged)
+			inFlight++
+			if stats != nil {
+				stats.retries.Add(1)
+			}
+
+		case result := <-results:
+			inFlight--
+
+			if result.err != nil {
+				cancels[result.attempt]()
+
+				// only give up if there's no other attempt which might still succeed
+				if inFlight == 0 {
+					return nil, result.err
+				}
+				continue
+			}
+
+			t.record(result.elapsed)
+
+			// cancel the loser, and discard its response if it gets one anyway
+			for i, cancel := range cancels {
+				if i != result.attempt {
+					cancel()
+				}
+			}
+			if inFlight > 0 {
+				go discardHedges(results, inFlight)
+			}
+
+			// the winner's context can only be cancelled once its body is done with
+			result.response.Body = &cancelOnClose{ReadCloser: result.response.Body, cancel: cancels[result.attempt]}
+			return result.response, nil
+		}
+	}
+}
+
+// delay returns how long to wait before hedging
+func (t *hedgingTransport) delay() time.Duration {
+	if t.config.Percentile <= 0 {
+		return t.config.Delay
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if len(t.latencies) < hedgingMinSamples {
+		return t.config.Delay
+	}
+
+	// clamp again in case the config was created without NewHedgingConfig
+	sorted := slices.Sorted(slices.Values(t.latencies))
+	return sorted[int(min(t.config.Percentile, 1)*float64(len(sorted)-1))]
+}
+
+// record records the latency of a successful request
+func (t *hedgingTransport) record(latency time.Duration) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.latencies = append(t.latencies, latency)
+	if len(t.latencies) > hedgingWindow {
+		t.latencies = t.latencies[len(t.latencies)-hedgingWindow:]
+	}
+}
+
+var _ http.RoundTripper = (*hedgingTransport)(nil)
+
+// discardHedges waits for the given number of losing attempts and closes any responses they got
+func discardHedges(results chan *hedgeResult, n int) {
+	for range n {
+		result := <-results
+		if result.response != nil {
+			result.response.Body.Close()
+		}
+	}
+}
+
+// cancelOnClose is a body which cancels its request's context once it's closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
@@ -0,0 +1,121 @@
+package httpx_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nyaruka/gocommon/httpx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithHedging(t *testing.T) {
+	slow := &httpx.MockResponse{Status: 200, Body: []byte("slow"), BodyIsString: true, Delay: time.Second}
+	fast := httpx.NewMockResponse(200, nil, []byte("fast"))
+
+	do := func(transport http.RoundTripper, method string, body io.Reader) (string, *httpx.Trace, error) {
+		ctx, traces := httpx.WithTraceCollector(context.Background())
+		req, err := httpx.NewRequest(ctx, method, "https://temba.io", body, nil)
+		require.NoError(t, err)
+
+		resp, err := httpx.WithTraces(transport).RoundTrip(req)
+		if err != nil {
+			return "", traces.Last(), err
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return string(b), traces.Last(), nil
+	}
+
+	// a slow request is hedged and the hedge wins
+	mocks := httpx.WithMocks(nil, map[string][]*httpx.MockResponse{"https://temba.io": {slow, fast}})
+	start := time.Now()
+	body, trace, err := do(httpx.WithHedging(mocks, httpx.NewHedgingConfig(20*time.Millisecond, 0)), "GET", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "fast", body)
+	assert.Equal(t, 1, trace.Retries)
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+	assert.Len(t, mocks.Requests(), 2)
+
+	// a fast request isn't hedged
+	mocks = httpx.WithMocks(nil, map[string][]*httpx.MockResponse{"https://temba.io": {fast}})
+	body, trace, err = do(httpx.WithHedging(mocks, httpx.NewHedgingConfig(time.Second, 0)), "GET", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "fast", body)
+	assert.Equal(t, 0, trace.Retries)
+
+	// a request which isn't idempotent isn't hedged
+	mocks = httpx.WithMocks(nil, map[string][]*httpx.MockResponse{"https://temba.io": {{Status: 200, Body: []byte("slow"), BodyIsString: true, Delay: 50 * time.Millisecond}}})
+	body, trace, err = do(httpx.WithHedging(mocks, httpx.NewHedgingConfig(time.Millisecond, 0)), "POST", strings.NewReader("hi"))
+	assert.NoError(t, err)
+	assert.Equal(t, "slow", body)
+	assert.Equal(t, 0, trace.Retries)
+	assert.False(t, mocks.HasUnused())
+
+	// a request which fails before the delay isn't hedged
+	mocks = httpx.WithMocks(nil, map[string][]*httpx.MockResponse{"https://temba.io": {httpx.MockConnectionError, fast}})
+	_, trace, err = do(httpx.WithHedging(mocks, httpx.NewHedgingConfig(time.Second, 0)), "GET", nil)
+	assert.EqualError(t, err, "unable to connect to server")
+	assert.Equal(t, 0, trace.Retries)
+	assert.True(t, mocks.HasUnused())
+
+	// but one that fails after the hedge was sent waits for the hedge
+	mocks = httpx.WithMocks(nil, map[string][]*httpx.MockResponse{"https://temba.io": {
+		{Status: 0, Body: []byte{}, BodyIsString: true, Delay: 50 * time.Millisecond},
+		{Status: 200, Body: []byte("hedge"), BodyIsString: true, Delay: 100 * time.Millisecond},
+	}})
+	body, trace, err = do(httpx.WithHedging(mocks, httpx.NewHedgingConfig(10*time.Millisecond, 0)), "GET", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "hedge", body)
+	assert.Equal(t, 1, trace.Retries)
+
+	// with a percentile, the delay adapts to recent latencies once there are enough of them
+	responses := make([]*httpx.MockResponse, 20)
+	for i := range responses {
+		responses[i] = fast
+	}
+	responses = append(responses, slow, fast)
+	mocks = httpx.WithMocks(nil, map[string][]*httpx.MockResponse{"https://temba.io": responses})
+	transport := httpx.WithHedging(mocks, httpx.NewHedgingConfig(10*time.Second, 0.9))
+	for range 20 {
+		_, trace, err = do(transport, "GET", nil)
+		require.NoError(t, err)
+		assert.Equal(t, 0, trace.Retries)
+	}
+
+	start = time.Now()
+	body, trace, err = do(transport, "GET", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "fast", body)
+	assert.Equal(t, 1, trace.Retries)
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+	assert.False(t, mocks.HasUnused())
+
+	// a percentile outside of 0-1 is clamped rather than indexing outside of the recent latencies
+	assert.Equal(t, 1.0, httpx.NewHedgingConfig(time.Second, 1.5).Percentile)
+	assert.Equal(t, 0.0, httpx.NewHedgingConfig(time.Second, -0.5).Percentile)
+
+	responses = make([]*httpx.MockResponse, 20)
+	for i := range responses {
+		responses[i] = fast
+	}
+	responses = append(responses, slow, fast)
+	mocks = httpx.WithMocks(nil, map[string][]*httpx.MockResponse{"https://temba.io": responses})
+	transport = httpx.WithHedging(mocks, &httpx.HedgingConfig{Delay: 10 * time.Second, Percentile: 1.5})
+	for range 20 {
+		_, _, err = do(transport, "GET", nil)
+		require.NoError(t, err)
+	}
+
+	start = time.Now()
+	body, trace, err = do(transport, "GET", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "fast", body)
+	assert.Equal(t, 1, trace.Retries)
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+	assert.False(t, mocks.HasUnused())
+}
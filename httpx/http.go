@@ -16,6 +16,9 @@ var ErrResponseSize = errors.New("response body exceeds size limit")
 // ErrAccessConfig is returned when provided access config prevents request
 var ErrAccessConfig = errors.New("request not permitted by access config")
 
+// ErrCircuitOpen is returned when a circuit breaker refuses a request to a failing host
+var ErrCircuitOpen = errors.New("circuit open for host")
+
 // NewRequest is a convenience method to create a request with the given context and headers
 func NewRequest(ctx context.Context, method string, url string, body io.Reader, headers map[string]string) (*http.Request, error) {
 	r, err := http.NewRequestWithContext(ctx, method, url, body)
@@ -15,27 +15,58 @@ type TraceSizes struct {
 	Response int `json:"response"`
 }
 
+// LogTimings is the breakdown of where the time of a request went, in milliseconds
+type LogTimings struct {
+	DNSMS       int  `json:"dns_ms"`
+	ConnectMS   int  `json:"connect_ms"`
+	TLSMS       int  `json:"tls_ms"`
+	FirstByteMS int  `json:"first_byte_ms"`
+	ConnReused  bool `json:"conn_reused"`
+}
+
+func newLogTimings(t *TraceTimings) *LogTimings {
+	if t == nil {
+		return nil
+	}
+	return &LogTimings{
+		DNSMS:       int(t.DNS / time.Millisecond),
+		ConnectMS:   int(t.Connect / time.Millisecond),
+		TLSMS:       int(t.TLS / time.Millisecond),
+		FirstByteMS: int(t.FirstByte / time.Millisecond),
+		ConnReused:  t.ConnReused,
+	}
+}
+
 // LogWithoutTime is a single HTTP trace that can be serialized/deserialized to/from JSON. Note that this struct has no
 // time component because it's intended to be embedded in something that does.
 type LogWithoutTime struct {
-	URL        string     `json:"url" validate:"required"`
-	StatusCode int        `json:"status_code,omitempty"`
-	Request    string     `json:"request" validate:"required"`
-	Response   string     `json:"response,omitempty"`
-	ElapsedMS  int        `json:"elapsed_ms"`
-	Retries    int        `json:"retries"`
-	Sizes      TraceSizes `json:"sizes"`
+	URL             string      `json:"url" validate:"required"`
+	StatusCode      int         `json:"status_code,omitempty"`
+	Request         string      `json:"request" validate:"required"`
+	Response        string      `json:"response,omitempty"`
+	ElapsedMS       int         `json:"elapsed_ms"`
+	Retries         int         `json:"retries"`
+	CircuitOpen     bool        `json:"circuit_open,omitempty"`
+	RateLimitWaitMS int         `json:"rate_limit_wait_ms,omitempty"`
+	Timings         *LogTimings `json:"timings,omitempty"`
+	Cache           CacheStatus `json:"cache,omitempty"`
+	Sizes           TraceSizes  `json:"sizes"`
 }
 
-// NewLogWithoutTime creates a new log
-func NewLogWithoutTime(trace *Trace, trimURLTo, trimTracesTo int, redact stringsx.Redactor) *LogWithoutTime {
-	url := trace.Request.URL.String()
-	request := trace.SanitizedRequest("...")
+// NewLogWithoutTime creates a new log. The given redactor (which may be nil) replaces known values, e.g. the secrets
+// of a channel, wherever they appear, and the given options can additionally mask values by where they appear, e.g.
+// an Authorization header or a password field in a JSON body.
+func NewLogWithoutTime(trace *Trace, trimURLTo, trimTracesTo int, redact stringsx.Redactor, opts ...LogOption) *LogWithoutTime {
+	cfg := newLogConfig(opts)
+
+	url := cfg.redactURL(trace.Request.URL.String())
+	request := cfg.redactTrace(trace.SanitizedRequest("..."), trace.Request.Header.Get("Content-Type"), true)
 	response := ReplaceEscapedNulls(trace.SanitizedResponse("..."), `�`)
 
 	statusCode := 0
 	if trace.Response != nil {
 		statusCode = trace.Response.StatusCode
+		response = cfg.redactTrace(response, trace.Response.Header.Get("Content-Type"), false)
 	}
 
 	if redact != nil {
@@ -45,13 +76,17 @@ func NewLogWithoutTime(trace *Trace, trimURLTo, trimTracesTo int, redact strings
 	}
 
 	return &LogWithoutTime{
-		URL:        stringsx.TruncateEllipsis(url, trimURLTo),
-		StatusCode: statusCode,
-		Request:    stringsx.TruncateEllipsis(request, trimTracesTo),
-		Response:   stringsx.TruncateEllipsis(response, trimTracesTo),
-		ElapsedMS:  int((trace.EndTime.Sub(trace.StartTime)) / time.Millisecond),
-		Retries:    trace.Retries,
-		Sizes:      TraceSizes{Request: trace.RequestSize(), Response: trace.ResponseSize()},
+		URL:             stringsx.TruncateEllipsis(url, trimURLTo),
+		StatusCode:      statusCode,
+		Request:         stringsx.TruncateEllipsis(request, trimTracesTo),
+		Response:        stringsx.TruncateEllipsis(response, trimTracesTo),
+		ElapsedMS:       int((trace.EndTime.Sub(trace.StartTime)) / time.Millisecond),
+		Retries:         trace.Retries,
+		CircuitOpen:     trace.CircuitOpen,
+		RateLimitWaitMS: int(trace.RateLimitWait / time.Millisecond),
+		Timings:         newLogTimings(trace.Timings),
+		Cache:           trace.Cache,
+		Sizes:           TraceSizes{Request: trace.RequestSize(), Response: trace.ResponseSize()},
 	}
 }
 
@@ -61,10 +96,10 @@ type Log struct {
 	CreatedOn time.Time `json:"created_on" validate:"required"`
 }
 
-// NewLog creates a new HTTP log from a trace
-func NewLog(trace *Trace, trimURLTo, trimTracesTo int, redact stringsx.Redactor) *Log {
+// NewLog creates a new HTTP log from a trace, redacting it as described by NewLogWithoutTime
+func NewLog(trace *Trace, trimURLTo, trimTracesTo int, redact stringsx.Redactor, opts ...LogOption) *Log {
 	return &Log{
-		NewLogWithoutTime(trace, trimURLTo, trimTracesTo, redact),
+		NewLogWithoutTime(trace, trimURLTo, trimTracesTo, redact, opts...),
 		trace.StartTime,
 	}
 }
@@ -2,6 +2,7 @@ package httpx_test
 
 import (
 	"context"
+	"io"
 	"net/http"
 	"strings"
 	"testing"
@@ -81,6 +82,69 @@ func TestLogs(t *testing.T) {
 	assert.Equal(t, "HTTP/1.0 400 Bad Request\r\nContent-Length: 39\r\n\r\nThe code is ****************, I said ****************", log3.Response)
 }
 
+func TestLogsStructuredRedaction(t *testing.T) {
+	tt := httpx.WithTraces(httpx.WithMocks(nil, map[string][]*httpx.MockResponse{
+		"http://temba.io/*": {
+			httpx.NewMockResponse(200, map[string]string{"Content-Type": "application/json", "X-Token": "abc"}, []byte(`{"access_token": "abc", "user": {"name": "Bob", "password": "xyz"}, "items": [{"pin": 1234}, {"pin": [5, 6]}]}`)),
+			httpx.NewMockResponse(200, map[string]string{"Content-Type": "application/x-www-form-urlencoded"}, []byte(`name=Bob&pass%77ord=xyz&token=abc`)),
+			httpx.NewMockResponse(200, map[string]string{"Content-Type": "application/json"}, []byte(`not json "password": "xyz"`)),
+		},
+	}))
+
+	trace := func(method, url, body string, headers map[string]string) *httpx.Trace {
+		ctx, traces := httpx.WithTraceCollector(context.Background())
+		req, err := httpx.NewRequest(ctx, method, url, strings.NewReader(body), headers)
+		require.NoError(t, err)
+		resp, err := tt.RoundTrip(req)
+		require.NoError(t, err)
+		io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return traces.Last()
+	}
+
+	opts := []httpx.LogOption{
+		httpx.RedactHeaders("authorization", "X-Token"),
+		httpx.RedactQueryParams("access_token"),
+		httpx.RedactFormFields("password", "token"),
+		httpx.RedactJSONPaths("access_token", "user.password", "items.*.pin"),
+	}
+
+	trace1 := trace("POST", "http://temba.io/send?access_token=abc&to=123", `{"access_token":"abc", "text": "hi"}`, map[string]string{"Authorization": "Token abc", "Content-Type": "application/json"})
+	log1 := httpx.NewLog(trace1, 2048, 10000, nil, opts...)
+	assert.Equal(t, "http://temba.io/send?access_token=**********&to=123", log1.URL)
+	assert.Equal(t, "POST /send?access_token=**********&to=123 HTTP/1.1\r\nHost: temba.io\r\nUser-Agent: Go-http-client/1.1\r\nContent-Length: 36\r\nAuthorization: **********\r\nContent-Type: application/json\r\nAccept-Encoding: gzip\r\n\r\n{\"access_token\":\"**********\", \"text\": \"hi\"}", log1.Request)
+	assert.Equal(t, "HTTP/1.0 200 OK\r\nContent-Length: 110\r\nContent-Type: application/json\r\nX-Token: **********\r\n\r\n{\"access_token\": \"**********\", \"user\": {\"name\": \"Bob\", \"password\": \"**********\"}, \"items\": [{\"pin\": \"**********\"}, {\"pin\": \"**********\"}]}", log1.Response)
+
+	// form bodies have fields redacted, and the literal redactor still applies alongside with its own mask
+	trace2 := trace("POST", "http://temba.io/login", `username=bob&password=xyz`, map[string]string{"Content-Type": "application/x-www-form-urlencoded"})
+	log2 := httpx.NewLog(trace2, 2048, 10000, stringsx.NewRedactor("####", "bob", "Bob"), append(opts, httpx.RedactMask("XXX"))...)
+	assert.True(t, strings.HasSuffix(log2.Request, "\r\n\r\nusername=####&password=XXX"), log2.Request)
+	assert.True(t, strings.HasSuffix(log2.Response, "\r\n\r\nname=####&pass%77ord=XXX&token=XXX"), log2.Response)
+
+	// bodies which aren't what their content type says are masked entirely as we can't tell what's in them
+	trace3 := trace("GET", "http://temba.io/", "", nil)
+	log3 := httpx.NewLog(trace3, 2048, 10000, nil, opts...)
+	assert.True(t, strings.HasSuffix(log3.Response, "\r\n\r\n**********"), log3.Response)
+
+	// bodies cut short by a capture limit are redacted up to where they were cut, and the rest masked
+	tt = httpx.WithTraces(httpx.WithMocks(nil, map[string][]*httpx.MockResponse{
+		"http://temba.io/*": {
+			httpx.NewMockResponse(200, map[string]string{"Content-Type": "application/json"}, []byte(`{"access_token": "abc", "user": {"name": "Bob", "password": "xyz123"}}`)),
+			httpx.NewMockResponse(200, map[string]string{"Content-Type": "application/json"}, []byte(`{"access_token": "abc", "user": {"name": "Bob", "password": "xyz123"}}`)),
+		},
+	}), httpx.TraceCaptureLimit(64))
+
+	trace4 := trace("GET", "http://temba.io/", "", nil)
+	log4 := httpx.NewLog(trace4, 2048, 10000, nil, opts...)
+	assert.True(t, strings.HasSuffix(log4.Response, "\r\n\r\n{\"access_token\": \"**********\", \"user\": {\"name\": \"Bob\", \"password\": **********"), log4.Response)
+	assert.NotContains(t, log4.Response, "xyz")
+
+	// and without any JSON paths to redact, they're left alone
+	trace5 := trace("GET", "http://temba.io/", "", nil)
+	log5 := httpx.NewLog(trace5, 2048, 10000, nil)
+	assert.True(t, strings.HasSuffix(log5.Response, "\r\n\r\n{\"access_token\": \"abc\", \"user\": {\"name\": \"Bob\", \"password\": \"xyz"), log5.Response)
+}
+
 func TestReplaceEscapedNulls(t *testing.T) {
 	assert.Equal(t, ``, httpx.ReplaceEscapedNulls(``, `?`))
 	assert.Equal(t, `abcdef`, httpx.ReplaceEscapedNulls(`abc\u0000def`, ``))
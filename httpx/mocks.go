@@ -2,40 +2,59 @@ package httpx
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"maps"
+	"net"
 	"net/http"
+	"os"
+	"reflect"
+	"regexp"
 	"slices"
+	"strings"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/nyaruka/gocommon/jsonx"
 	"github.com/nyaruka/gocommon/stringsx"
 )
 
-// takeMock pops the next mocked response matching the request's URL, mutating mocks. Returns nil if none match.
-func takeMock(mocks map[string][]*MockResponse, request *http.Request) *MockResponse {
+// takeMock pops the next mocked response matching the request, mutating mocks. Returns nil if none match, along with
+// descriptions of why any mocks for the request's URL didn't match it.
+func takeMock(mocks map[string][]*MockResponse, request *http.Request, body []byte) (*MockResponse, []string) {
 	url := request.URL.String()
 
 	// find the most specific match against this URL
 	match := stringsx.GlobSelect(url, slices.Collect(maps.Keys(mocks))...)
 	mockedResponses := mocks[match]
 	if len(mockedResponses) == 0 {
-		return nil
+		return nil, nil
 	}
 
-	// pop the next mocked response for this URL
-	mocked := mockedResponses[0]
-	remaining := mockedResponses[1:]
-	if len(remaining) > 0 {
-		mocks[match] = remaining
-	} else {
-		delete(mocks, match)
+	// pop the first mocked response for this URL which matches the rest of the request
+	var mismatches []string
+	for i, mocked := range mockedResponses {
+		if mismatch := mocked.Match.mismatch(request, body); mismatch != "" {
+			mismatches = append(mismatches, fmt.Sprintf("mock #%d: %s", i, mismatch))
+			continue
+		}
+
+		remaining := slices.Delete(slices.Clone(mockedResponses), i, i+1)
+		if len(remaining) > 0 {
+			mocks[match] = remaining
+		} else {
+			delete(mocks, match)
+		}
+		return mocked, nil
 	}
 
-	return mocked
+	return nil, mismatches
 }
 
 // hasUnusedMocks returns whether any unused mocked responses remain
@@ -96,10 +115,21 @@ func (t *MocksTransport) RoundTrip(request *http.Request) (*http.Response, error
 		return t.inner.RoundTrip(request)
 	}
 
+	// read the request body so mocks can match against it, leaving a readable copy on the request
+	var body []byte
+	if request.Body != nil && request.Body != http.NoBody {
+		var err error
+		if body, err = io.ReadAll(request.Body); err != nil {
+			return nil, err
+		}
+		request.Body.Close()
+		request.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
 	// take the next matching mock and record the request under lock, but don't hold it across any delegation to
 	// the inner transport which may block on I/O
 	t.mutex.Lock()
-	mocked := takeMock(t.mocks, request)
+	mocked, mismatches := takeMock(t.mocks, request, body)
 	if mocked != nil {
 		t.requests = append(t.requests, request)
 	}
@@ -110,11 +140,20 @@ func (t *MocksTransport) RoundTrip(request *http.Request) (*http.Response, error
 		if t.passthrough {
 			return t.inner.RoundTrip(request)
 		}
+		if len(mismatches) > 0 {
+			panic(fmt.Sprintf("no mock for %s %s matched the request:\n  %s", request.Method, request.URL.String(), strings.Join(mismatches, "\n  ")))
+		}
 		panic(fmt.Sprintf("missing mock for URL %s", request.URL.String()))
 	}
 
-	if mocked.Status == 0 {
-		return nil, errors.New("unable to connect to server")
+	if mocked.Delay > 0 {
+		if err := wait(request.Context(), mocked.Delay); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := mocked.err(request); err != nil {
+		return nil, err
 	}
 
 	return mocked.Make(request), nil
@@ -139,24 +178,118 @@ var _ http.RoundTripper = (*MocksTransport)(nil)
 type MockResponse struct {
 	Status       int
 	Headers      map[string]string
+	MultiHeaders map[string][]string // headers with more than one value, e.g. Set-Cookie
 	Body         []byte
 	BodyIsString bool
 	BodyRepeat   int
+	Match        *MockMatch    // optional restrictions on which requests this can answer
+	Delay        time.Duration // how long to wait before responding
+	ChunkSize    int           // if non-zero, the body is sent in chunks of this size without a Content-Length
+	ChunkDelay   time.Duration // how long to wait before sending each chunk of a chunked body
+	BodyError    string        // if set, reading the body fails with this error once the body has been read
+	Error        MockError     // if set, the request fails with this kind of error instead of getting a response
+}
+
+// MockError is a kind of error that a mocked response can fail with instead of responding
+type MockError string
+
+const (
+	MockErrorConnection MockError = "connection" // generic connection error, also used for mocks with zero status
+	MockErrorRefused    MockError = "refused"    // connection refused
+	MockErrorDNS        MockError = "dns"        // host couldn't be resolved
+	MockErrorTimeout    MockError = "timeout"    // timed out connecting
+	MockErrorTLS        MockError = "tls"        // TLS handshake failed because the certificate couldn't be verified
+)
+
+// err returns the error this mocked response fails the given request with, if any. These are the same types of errors
+// that a real transport returns, so code which inspects errors, e.g. for net.Error timeouts, sees what it would in
+// production.
+func (m *MockResponse) err(request *http.Request) error {
+	kind := m.Error
+	if kind == "" && m.Status == 0 {
+		kind = MockErrorConnection
+	}
+
+	switch kind {
+	case "":
+		return nil
+	case MockErrorRefused:
+		return &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+	case MockErrorDNS:
+		return &net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: request.URL.Hostname(), IsNotFound: true}}
+	case MockErrorTimeout:
+		return &net.OpError{Op: "dial", Net: "tcp", Err: os.ErrDeadlineExceeded}
+	case MockErrorTLS:
+		return &tls.CertificateVerificationError{Err: x509.UnknownAuthorityError{}}
+	default:
+		return errors.New("unable to connect to server")
+	}
+}
+
+// MockMatch restricts which requests to a mocked URL a mocked response can answer. Empty fields match anything.
+type MockMatch struct {
+	Method    string            `json:"method,omitempty"`
+	Headers   map[string]string `json:"headers,omitempty"`    // header values which must be present
+	Body      string            `json:"body,omitempty"`       // substring the body must contain
+	BodyJSON  json.RawMessage   `json:"body_json,omitempty"`  // JSON the body must be equivalent to
+	BodyRegex string            `json:"body_regex,omitempty"` // regular expression the body must match
+}
+
+// mismatch returns a description of how the given request doesn't match, or empty string if it does
+func (m *MockMatch) mismatch(request *http.Request, body []byte) string {
+	if m == nil {
+		return ""
+	}
+	if m.Method != "" && !strings.EqualFold(m.Method, request.Method) {
+		return fmt.Sprintf("method: expected %s, got %s", m.Method, request.Method)
+	}
+	for _, k := range slices.Sorted(maps.Keys(m.Headers)) {
+		if actual := request.Header.Get(k); actual != m.Headers[k] {
+			return fmt.Sprintf("header %s: expected %q, got %q", k, m.Headers[k], actual)
+		}
+	}
+	if m.Body != "" && !bytes.Contains(body, []byte(m.Body)) {
+		return fmt.Sprintf("body: expected to contain %q, got %q", m.Body, body)
+	}
+	if len(m.BodyJSON) > 0 {
+		var expected, actual any
+		if err := json.Unmarshal(m.BodyJSON, &expected); err != nil {
+			return fmt.Sprintf("body: invalid expected JSON: %s", err)
+		}
+		if err := json.Unmarshal(body, &actual); err != nil || !reflect.DeepEqual(expected, actual) {
+			return fmt.Sprintf("body: expected JSON %s, got %s", m.BodyJSON, body)
+		}
+	}
+	if m.BodyRegex != "" {
+		re, err := regexp.Compile(m.BodyRegex)
+		if err != nil {
+			return fmt.Sprintf("body: invalid regex: %s", err)
+		}
+		if !re.Match(body) {
+			return fmt.Sprintf("body: expected to match %s, got %q", m.BodyRegex, body)
+		}
+	}
+	return ""
 }
 
 // Make mocks making the given request and returning this as the response
 func (m *MockResponse) Make(request *http.Request) *http.Response {
-	header := make(http.Header, len(m.Headers))
+	header := make(http.Header, len(m.Headers)+len(m.MultiHeaders))
 	for k, v := range m.Headers {
 		header.Set(k, v)
 	}
+	for k, vs := range m.MultiHeaders {
+		for _, v := range vs {
+			header.Add(k, v)
+		}
+	}
 
 	body := m.Body
 	if m.BodyRepeat > 1 {
 		body = bytes.Repeat(body, m.BodyRepeat)
 	}
 
-	return &http.Response{
+	response := &http.Response{
 		Request:       request,
 		Status:        fmt.Sprintf("%d %s", m.Status, http.StatusText(m.Status)),
 		StatusCode:    m.Status,
@@ -167,8 +300,57 @@ func (m *MockResponse) Make(request *http.Request) *http.Response {
 		Body:          io.NopCloser(bytes.NewReader(body)),
 		ContentLength: int64(len(body)),
 	}
+
+	if m.ChunkSize > 0 || m.BodyError != "" {
+		response.Body = &mockBody{ctx: request.Context(), body: body, chunkSize: m.ChunkSize, chunkDelay: m.ChunkDelay, err: m.BodyError}
+	}
+	if m.ChunkSize > 0 {
+		response.ContentLength = -1
+		response.TransferEncoding = []string{"chunked"}
+	}
+
+	return response
+}
+
+// mockBody is the body of a mocked response which can be sent slowly in chunks and can fail after it's been read
+type mockBody struct {
+	ctx        context.Context
+	body       []byte
+	chunkSize  int
+	chunkDelay time.Duration
+	err        string
+	chunk      []byte // remainder of the current chunk
+}
+
+func (b *mockBody) Read(p []byte) (int, error) {
+	if len(b.chunk) == 0 {
+		if len(b.body) == 0 {
+			if b.err != "" {
+				return 0, errors.New(b.err)
+			}
+			return 0, io.EOF
+		}
+
+		size := len(b.body)
+		if b.chunkSize > 0 {
+			size = min(b.chunkSize, size)
+
+			if b.chunkDelay > 0 {
+				if err := wait(b.ctx, b.chunkDelay); err != nil {
+					return 0, err
+				}
+			}
+		}
+		b.chunk, b.body = b.body[:size], b.body[size:]
+	}
+
+	n := copy(p, b.chunk)
+	b.chunk = b.chunk[n:]
+	return n, nil
 }
 
+func (b *mockBody) Close() error { return nil }
+
 // MockConnectionError mocks a connection error
 var MockConnectionError = &MockResponse{Status: 0, Headers: nil, Body: []byte{}, BodyIsString: true, BodyRepeat: 0}
 
@@ -177,6 +359,51 @@ func NewMockResponse(status int, headers map[string]string, body []byte) *MockRe
 	return &MockResponse{Status: status, Headers: headers, Body: body, BodyIsString: true, BodyRepeat: 0}
 }
 
+// NewMockResponseFromTrace creates a mock response which replays the response of the given trace, or a connection
+// error if the trace has no response
+func NewMockResponseFromTrace(trace *Trace) *MockResponse {
+	if trace.Response == nil {
+		return MockConnectionError
+	}
+
+	mocked := NewMockResponse(trace.Response.StatusCode, nil, slices.Clone(trace.ResponseBody))
+	mocked.Headers, mocked.MultiHeaders = mockHeaders(trace.Response.Header)
+	return mocked
+}
+
+// mockHeaders converts the headers of a real response to those of a mocked response, splitting out those with more
+// than one value, and skipping those which describe the original transfer rather than the response
+func mockHeaders(header http.Header) (map[string]string, map[string][]string) {
+	headers := make(map[string]string, len(header))
+	var multi map[string][]string
+
+	for k, vs := range header {
+		if slices.Contains(cassetteSkipHeaders, k) || len(vs) == 0 {
+			continue
+		}
+		if len(vs) > 1 {
+			if multi == nil {
+				multi = make(map[string][]string)
+			}
+			multi[k] = slices.Clone(vs)
+		} else {
+			headers[k] = vs[0]
+		}
+	}
+	return headers, multi
+}
+
+// NewMocksFromTraces creates mocks which replay the responses of the given traces, e.g. to reproduce a bug from
+// persisted traces by passing them to WithMocks
+func NewMocksFromTraces(traces []*Trace) map[string][]*MockResponse {
+	mocks := make(map[string][]*MockResponse)
+	for _, t := range traces {
+		url := t.Request.URL.String()
+		mocks[url] = append(mocks[url], NewMockResponseFromTrace(t))
+	}
+	return mocks
+}
+
 func isLocalRequest(r *http.Request) bool {
 	hostname := r.URL.Hostname()
 	return hostname == "localhost" || hostname == "127.0.0.1"
@@ -187,10 +414,17 @@ func isLocalRequest(r *http.Request) bool {
 //------------------------------------------------------------------------------------------
 
 type mockResponseEnvelope struct {
-	Status     int               `json:"status" validate:"required"`
-	Headers    map[string]string `json:"headers,omitempty"`
-	Body       json.RawMessage   `json:"body" validate:"required"`
-	BodyRepeat int               `json:"body_repeat,omitempty"`
+	Status       int                 `json:"status" validate:"required"`
+	Headers      map[string]string   `json:"headers,omitempty"`
+	MultiHeaders map[string][]string `json:"multi_headers,omitempty"`
+	Body         json.RawMessage     `json:"body" validate:"required"`
+	BodyRepeat   int                 `json:"body_repeat,omitempty"`
+	Match        *MockMatch          `json:"match,omitempty"`
+	DelayMS      int                 `json:"delay_ms,omitempty"`
+	ChunkSize    int                 `json:"chunk_size,omitempty"`
+	ChunkDelayMS int                 `json:"chunk_delay_ms,omitempty"`
+	BodyError    string              `json:"body_error,omitempty"`
+	Error        MockError           `json:"error,omitempty"`
 }
 
 func (m *MockResponse) MarshalJSON() ([]byte, error) {
@@ -202,10 +436,17 @@ func (m *MockResponse) MarshalJSON() ([]byte, error) {
 	}
 
 	return jsonx.Marshal(&mockResponseEnvelope{
-		Status:     m.Status,
-		Headers:    m.Headers,
-		Body:       body,
-		BodyRepeat: m.BodyRepeat,
+		Status:       m.Status,
+		Headers:      m.Headers,
+		MultiHeaders: m.MultiHeaders,
+		Body:         body,
+		BodyRepeat:   m.BodyRepeat,
+		Match:        m.Match,
+		DelayMS:      int(m.Delay / time.Millisecond),
+		ChunkSize:    m.ChunkSize,
+		ChunkDelayMS: int(m.ChunkDelay / time.Millisecond),
+		BodyError:    m.BodyError,
+		Error:        m.Error,
 	})
 }
 
@@ -217,7 +458,14 @@ func (m *MockResponse) UnmarshalJSON(data []byte) error {
 
 	m.Status = e.Status
 	m.Headers = e.Headers
+	m.MultiHeaders = e.MultiHeaders
 	m.BodyRepeat = e.BodyRepeat
+	m.Match = e.Match
+	m.Delay = time.Duration(e.DelayMS) * time.Millisecond
+	m.ChunkSize = e.ChunkSize
+	m.ChunkDelay = time.Duration(e.ChunkDelayMS) * time.Millisecond
+	m.BodyError = e.BodyError
+	m.Error = e.Error
 
 	if len(e.Body) > 0 && e.Body[0] == '"' {
 		var bodyAsString string
@@ -1,11 +1,17 @@
 package httpx_test
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"io"
+	"net"
 	"net/http"
+	"strings"
 	"sync"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/nyaruka/gocommon/httpx"
 	"github.com/nyaruka/gocommon/jsonx"
@@ -106,6 +112,56 @@ func TestMocksTransport(t *testing.T) {
 	assert.Empty(t, mt.Requests())
 }
 
+func TestMocksTransportMatching(t *testing.T) {
+	mt := httpx.WithMocks(nil, map[string][]*httpx.MockResponse{
+		"https://temba.io/*": {
+			{Status: 201, Body: []byte("created"), BodyIsString: true, Match: &httpx.MockMatch{Method: "POST", BodyJSON: json.RawMessage(`{"name": "Bob", "age": 32}`)}},
+			{Status: 200, Body: []byte("got"), BodyIsString: true, Match: &httpx.MockMatch{Method: "GET", Headers: map[string]string{"Authorization": "Token 123"}}},
+			{Status: 202, Body: []byte("accepted"), BodyIsString: true, Match: &httpx.MockMatch{Body: "hello", BodyRegex: `^\w+ world$`}},
+		},
+	})
+
+	call := func(method, body string, headers map[string]string) *http.Response {
+		req, err := httpx.NewRequest(t.Context(), method, "https://temba.io/api", strings.NewReader(body), headers)
+		require.NoError(t, err)
+		resp, err := mt.RoundTrip(req)
+		require.NoError(t, err)
+		return resp
+	}
+
+	// mocks are taken in order of the first that matches, not the first for the URL
+	assert.Equal(t, 200, call("GET", "", map[string]string{"Authorization": "Token 123"}).StatusCode)
+	assert.Equal(t, 202, call("PUT", "hello world", nil).StatusCode)
+
+	// the request body remains readable after being matched
+	assert.Equal(t, 201, call("POST", `{"age":32,"name":"Bob"}`, nil).StatusCode)
+	requests := mt.Requests()
+	require.Len(t, requests, 3)
+	body, err := io.ReadAll(requests[2].Body)
+	require.NoError(t, err)
+	assert.Equal(t, `{"age":32,"name":"Bob"}`, string(body))
+	assert.False(t, mt.HasUnused())
+
+	// a request which doesn't match any of the mocks for its URL panics with the reasons why
+	mt = httpx.WithMocks(nil, map[string][]*httpx.MockResponse{
+		"https://temba.io/*": {
+			{Status: 201, Match: &httpx.MockMatch{Method: "POST"}},
+			{Status: 201, Match: &httpx.MockMatch{Headers: map[string]string{"Authorization": "Token 123"}}},
+			{Status: 201, Match: &httpx.MockMatch{Body: "bye"}},
+			{Status: 201, Match: &httpx.MockMatch{BodyJSON: json.RawMessage(`{"name": "Jim"}`)}},
+			{Status: 201, Match: &httpx.MockMatch{BodyRegex: `^\d+$`}},
+		},
+	})
+	req, _ := httpx.NewRequest(t.Context(), "GET", "https://temba.io/api", strings.NewReader(`{"name": "Bob"}`), nil)
+	assert.PanicsWithValue(t, `no mock for GET https://temba.io/api matched the request:
+  mock #0: method: expected POST, got GET
+  mock #1: header Authorization: expected "Token 123", got ""
+  mock #2: body: expected to contain "bye", got "{\"name\": \"Bob\"}"
+  mock #3: body: expected JSON {"name": "Jim"}, got {"name": "Bob"}
+  mock #4: body: expected to match ^\d+$, got "{\"name\": \"Bob\"}"`, func() { mt.RoundTrip(req) })
+	assert.True(t, mt.HasUnused())
+}
+
 func TestMocksTransportConcurrent(t *testing.T) {
 	// a MocksTransport shared across a client used by multiple goroutines must be safe for concurrent use, as the
 	// http.RoundTripper contract requires - run under -race to detect any unsynchronized access to mocks/requests
@@ -137,6 +193,76 @@ func TestMocksTransportConcurrent(t *testing.T) {
 	assert.False(t, mt.HasUnused())
 }
 
+func TestMocksTransportFailureModes(t *testing.T) {
+	mt := httpx.WithMocks(http.DefaultTransport, map[string][]*httpx.MockResponse{
+		"https://temba.io/slow":    {{Status: 200, Body: []byte("ok"), Delay: 100 * time.Millisecond}},
+		"https://temba.io/chunked": {{Status: 200, Body: []byte("abcdefg"), ChunkSize: 3, ChunkDelay: 10 * time.Millisecond}},
+		"https://temba.io/broken":  {{Status: 200, Body: []byte("partial"), BodyError: "connection reset by peer"}},
+		"https://temba.io/errors": {
+			{Error: httpx.MockErrorRefused},
+			{Error: httpx.MockErrorDNS},
+			{Error: httpx.MockErrorTimeout},
+			{Error: httpx.MockErrorTLS},
+			httpx.MockConnectionError,
+		},
+	})
+
+	// a delayed response is cut short by the request's context
+	ctx, cancel := context.WithTimeout(t.Context(), 10*time.Millisecond)
+	defer cancel()
+	req, _ := httpx.NewRequest(ctx, "GET", "https://temba.io/slow", nil, nil)
+	_, err := mt.RoundTrip(req)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// a chunked body is read in chunks without a known length
+	req, _ = httpx.NewRequest(t.Context(), "GET", "https://temba.io/chunked", nil, nil)
+	resp, err := mt.RoundTrip(req)
+	require.NoError(t, err)
+	assert.Equal(t, int64(-1), resp.ContentLength)
+
+	start := time.Now()
+	buf := make([]byte, 10)
+	n, err := resp.Body.Read(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "abc", string(buf[:n]))
+	body, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "defg", string(body))
+	assert.GreaterOrEqual(t, time.Since(start), 30*time.Millisecond)
+
+	// a body which fails after it's been read
+	req, _ = httpx.NewRequest(t.Context(), "GET", "https://temba.io/broken", nil, nil)
+	resp, err = mt.RoundTrip(req)
+	require.NoError(t, err)
+	body, err = io.ReadAll(resp.Body)
+	assert.EqualError(t, err, "connection reset by peer")
+	assert.Equal(t, "partial", string(body))
+
+	// errors are the same types as real transports return
+	req, _ = httpx.NewRequest(t.Context(), "GET", "https://temba.io/errors", nil, nil)
+	_, err = mt.RoundTrip(req)
+	assert.ErrorIs(t, err, syscall.ECONNREFUSED)
+
+	_, err = mt.RoundTrip(req)
+	var dnsErr *net.DNSError
+	assert.ErrorAs(t, err, &dnsErr)
+	assert.Equal(t, "temba.io", dnsErr.Name)
+
+	_, err = mt.RoundTrip(req)
+	var netErr net.Error
+	assert.ErrorAs(t, err, &netErr)
+	assert.True(t, netErr.Timeout())
+
+	_, err = mt.RoundTrip(req)
+	var tlsErr *tls.CertificateVerificationError
+	assert.ErrorAs(t, err, &tlsErr)
+
+	_, err = mt.RoundTrip(req)
+	assert.EqualError(t, err, "unable to connect to server")
+
+	assert.False(t, mt.HasUnused())
+}
+
 func TestMockResponseMarshaling(t *testing.T) {
 	mocks := map[string][]*httpx.MockResponse{
 		"http://google.com": {
@@ -146,10 +272,26 @@ func TestMockResponseMarshaling(t *testing.T) {
 				Status: 202,
 				Body:   []byte(`{"foo": "bar"}`),
 			},
+			&httpx.MockResponse{
+				Status:       200,
+				Body:         []byte("matched"),
+				BodyIsString: true,
+				Match:        &httpx.MockMatch{Method: "POST", Headers: map[string]string{"X-Foo": "bar"}, BodyJSON: json.RawMessage(`{"id":1}`)},
+			},
 		},
 		"http://yahoo.com": {
 			httpx.NewMockResponse(202, nil, []byte("this is yahoo")),
 			httpx.MockConnectionError,
+			&httpx.MockResponse{
+				Status:       200,
+				Body:         []byte("slow"),
+				BodyIsString: true,
+				Delay:        2 * time.Second,
+				ChunkSize:    2,
+				ChunkDelay:   100 * time.Millisecond,
+				BodyError:    "connection reset by peer",
+			},
+			&httpx.MockResponse{Body: []byte{}, BodyIsString: true, Error: httpx.MockErrorTLS},
 		},
 	}
 
@@ -157,11 +299,14 @@ func TestMockResponseMarshaling(t *testing.T) {
 		"http://google.com": [
 			{"status": 200, "body": "this is google"},
 			{"status": 201, "body": "this is google again"},
-			{"status": 202, "body": {"foo": "bar"}}
+			{"status": 202, "body": {"foo": "bar"}},
+			{"status": 200, "body": "matched", "match": {"method": "POST", "headers": {"X-Foo": "bar"}, "body_json": {"id":1}}}
 		],
 		"http://yahoo.com": [
 			{"status": 202, "body": "this is yahoo"},
-			{"status": 0, "body": ""}
+			{"status": 0, "body": ""},
+			{"status": 200, "body": "slow", "delay_ms": 2000, "chunk_size": 2, "chunk_delay_ms": 100, "body_error": "connection reset by peer"},
+			{"status": 0, "body": "", "error": "tls"}
 		]
 	}`)
 
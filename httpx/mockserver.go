@@ -0,0 +1,155 @@
+package httpx
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// MockServer is a real HTTP server on a local port which answers requests from a set of mocked responses, for testing
+// code which doesn't make its requests through a MocksTransport, e.g. another binary or a client we don't control.
+//
+// Mocks are defined in the same way as for WithMocks, but as requests are all made to the server, the scheme and host
+// of each URL are ignored and requests are matched on their path and query. For example a mock for
+// https://api.example.com/send answers requests to the server's /send. A request with no matching mock gets a 500
+// response describing why. A mock with a zero status or an error closes the connection without responding, whatever
+// the kind of error, and a mock with a body error aborts the response once the body has been sent.
+//
+//	server := httpx.NewMockServer(map[string][]*httpx.MockResponse{
+//		"https://api.example.com/send": {httpx.NewMockResponse(200, nil, []byte(`{"id": 123}`))},
+//	})
+//	defer server.Close()
+//
+//	// point the code under test at server.URL instead of https://api.example.com
+type MockServer struct {
+	*httptest.Server
+
+	mutex    sync.Mutex // guards mocks and requests
+	mocks    map[string][]*MockResponse
+	requests []*http.Request
+}
+
+// NewMockServer creates and starts a new mock server with the given mocks. The mocks map is copied, so the caller's
+// map is never consumed and can be safely reused.
+func NewMockServer(mocks map[string][]*MockResponse) *MockServer {
+	s := &MockServer{mocks: make(map[string][]*MockResponse, len(mocks))}
+
+	// add in URL order so that mocks for the same path on different hosts are answered in a predictable order
+	for _, u := range slices.Sorted(maps.Keys(mocks)) {
+		path := mockServerPath(u)
+		s.mocks[path] = append(s.mocks[path], mocks[u]...)
+	}
+
+	s.Server = httptest.NewUnstartedServer(http.HandlerFunc(s.serve))
+
+	// clients retry idempotent requests whose reused connection is closed without a response, which would turn a
+	// mocked connection error into a request for the next mock, so don't let connections be reused
+	s.Config.SetKeepAlivesEnabled(false)
+	s.Start()
+	return s
+}
+
+func (s *MockServer) serve(w http.ResponseWriter, r *http.Request) {
+	body, err := readAndRestoreBody(r, 0)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error reading request body: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	s.mutex.Lock()
+	mocked, mismatches := takeMock(s.mocks, r, body)
+	if mocked != nil {
+		s.requests = append(s.requests, r)
+	}
+	s.mutex.Unlock()
+
+	if mocked == nil {
+		if len(mismatches) > 0 {
+			http.Error(w, fmt.Sprintf("no mock for %s %s matched the request:\n  %s", r.Method, r.URL.String(), strings.Join(mismatches, "\n  ")), http.StatusInternalServerError)
+		} else {
+			http.Error(w, fmt.Sprintf("missing mock for URL %s", r.URL.String()), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if mocked.Delay > 0 {
+		if err := wait(r.Context(), mocked.Delay); err != nil {
+			return
+		}
+	}
+
+	if mocked.err(r) != nil {
+		// we can't fake the different kinds of error over a real connection, so close it without a response so that
+		// the client sees a connection error
+		if hj, ok := w.(http.Hijacker); ok {
+			if conn, _, err := hj.Hijack(); err == nil {
+				conn.Close()
+				return
+			}
+		}
+		panic(http.ErrAbortHandler)
+	}
+
+	response := mocked.Make(r)
+	defer response.Body.Close()
+
+	for k, vs := range response.Header {
+		w.Header()[k] = vs
+	}
+	w.WriteHeader(response.StatusCode)
+
+	// copy the body a read at a time, flushing after each so that chunks are sent as they're read
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := response.Body.Read(buf)
+		if n > 0 {
+			w.Write(buf[:n])
+			http.NewResponseController(w).Flush()
+		}
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			// abort the response mid-body so that the client sees a read error
+			panic(http.ErrAbortHandler)
+		}
+	}
+}
+
+// Requests returns a snapshot of the requests that were answered from mocks
+func (s *MockServer) Requests() []*http.Request {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return slices.Clone(s.requests)
+}
+
+// HasUnused returns true if there are unused mocks leftover
+func (s *MockServer) HasUnused() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return hasUnusedMocks(s.mocks)
+}
+
+// mockServerPath strips the scheme and host from a mocked URL, e.g. https://example.com/foo?bar=1 becomes /foo?bar=1
+func mockServerPath(u string) string {
+	_, rest, found := strings.Cut(u, "://")
+	if !found {
+		return u
+	}
+	if i := strings.IndexAny(rest, "/?"); i >= 0 {
+		path := rest[i:]
+		if path[0] == '?' {
+			path = "/" + path
+		}
+		return path
+	}
+	if strings.Contains(rest, "*") {
+		return "*" // e.g. https://* matches anything
+	}
+	return "/"
+}
@@ -0,0 +1,96 @@
+package httpx_test
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nyaruka/gocommon/httpx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMockServer(t *testing.T) {
+	server := httpx.NewMockServer(map[string][]*httpx.MockResponse{
+		"https://api.example.com/send": {
+			httpx.NewMockResponse(200, map[string]string{"Content-Type": "application/json"}, []byte(`{"id": 123}`)),
+			{Status: 202, Body: []byte(`accepted`), BodyIsString: true, Match: &httpx.MockMatch{Method: "POST", Body: "hello"}},
+		},
+		"https://api.example.com/status?id=*": {
+			httpx.NewMockResponse(404, nil, []byte(`not found`)),
+		},
+		"https://api.example.com/broken": {
+			httpx.MockConnectionError,
+			{Status: 200, Body: []byte("partial"), BodyError: "connection reset by peer"},
+		},
+		"https://api.example.com/chunked": {
+			{Status: 200, Body: []byte("abcdefg"), ChunkSize: 3, Delay: 10 * time.Millisecond},
+		},
+	})
+	defer server.Close()
+
+	get := func(path string) (int, string) {
+		resp, err := http.Get(server.URL + path)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	status, body := get("/send")
+	assert.Equal(t, 200, status)
+	assert.Equal(t, `{"id": 123}`, body)
+
+	status, body = get("/status?id=5")
+	assert.Equal(t, 404, status)
+	assert.Equal(t, `not found`, body)
+
+	// next mock for /send requires a POST
+	status, body = get("/send")
+	assert.Equal(t, 500, status)
+	assert.Equal(t, "no mock for GET /send matched the request:\n  mock #0: method: expected POST, got GET\n", body)
+
+	assert.True(t, server.HasUnused())
+
+	resp, err := http.Post(server.URL+"/send", "text/plain", strings.NewReader("hello world"))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, 202, resp.StatusCode)
+
+	_, err = http.Get(server.URL + "/broken")
+	assert.Error(t, err)
+
+	// a body error aborts the response after the body has been sent
+	resp, err = http.Get(server.URL + "/broken")
+	require.NoError(t, err)
+	partial, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Error(t, err)
+	assert.Equal(t, "partial", string(partial))
+
+	resp, err = http.Get(server.URL + "/chunked")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"chunked"}, resp.TransferEncoding)
+	chunked, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, "abcdefg", string(chunked))
+
+	status, body = get("/other")
+	assert.Equal(t, 500, status)
+	assert.Equal(t, "missing mock for URL /other\n", body)
+
+	assert.False(t, server.HasUnused())
+
+	requests := server.Requests()
+	if assert.Len(t, requests, 6) {
+		assert.Equal(t, "/send", requests[0].URL.String())
+		assert.Equal(t, "/status?id=5", requests[1].URL.String())
+		assert.Equal(t, "POST", requests[2].Method)
+
+		posted, _ := io.ReadAll(requests[2].Body)
+		assert.Equal(t, "hello world", string(posted))
+	}
+}
@@ -0,0 +1,157 @@
+package httpx
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/nyaruka/gocommon/jsonx"
+)
+
+var validate = validator.New()
+
+func init() {
+	// report fields by their JSON names so that paths match what the client sent
+	validate.RegisterTagNameFunc(func(f reflect.StructField) string {
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			return ""
+		}
+		if name == "" {
+			return f.Name
+		}
+		return name
+	})
+}
+
+// Problem is a problem details response as described by RFC 7807. It's also an error so that it can be returned by
+// request handling code and written as a response with WriteProblem.
+type Problem struct {
+	Type     string        `json:"type,omitempty"`
+	Title    string        `json:"title"`
+	Status   int           `json:"status"`
+	Detail   string        `json:"detail,omitempty"`
+	Instance string        `json:"instance,omitempty"`
+	Errors   []*FieldError `json:"errors,omitempty"` // extension member with the fields which failed validation
+}
+
+// NewProblem creates a new problem with the given status, titled with that status's text
+func NewProblem(status int, detail string) *Problem {
+	return &Problem{Title: http.StatusText(status), Status: status, Detail: detail}
+}
+
+func (p *Problem) Error() string {
+	if p.Detail != "" {
+		return fmt.Sprintf("%s: %s", p.Title, p.Detail)
+	}
+	return p.Title
+}
+
+// FieldError is a field of a request body which failed validation
+type FieldError struct {
+	Field   string `json:"field"` // path of the field using JSON names, e.g. contacts[0].name
+	Tag     string `json:"tag"`   // validation tag which failed, e.g. required
+	Message string `json:"message"`
+}
+
+// DecodeJSON decodes the JSON body of the given request into v and validates it using its validate struct tags. The
+// body must have a JSON content type and be no more than limit bytes. If it can't be decoded, the returned error is
+// a *Problem with a 415, 413, 400 or 422 status as appropriate, which can be written with WriteProblem.
+func DecodeJSON(r *http.Request, v any, limit int64) error {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json") {
+		return NewProblem(http.StatusUnsupportedMediaType, fmt.Sprintf("expected content type application/json, got '%s'", r.Header.Get("Content-Type")))
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+	r.Body.Close()
+	if err != nil {
+		return NewProblem(http.StatusBadRequest, "unable to read request body")
+	}
+	if int64(len(body)) > limit {
+		return NewProblem(http.StatusRequestEntityTooLarge, fmt.Sprintf("request body exceeds limit of %d bytes", limit))
+	}
+
+	if err := json.Unmarshal(body, v); err != nil {
+		return NewProblem(http.StatusBadRequest, describeJSONError(body, err))
+	}
+
+	if err := validate.Struct(v); err != nil {
+		var verrs validator.ValidationErrors
+		if errors.As(err, &verrs) {
+			p := NewProblem(http.StatusUnprocessableEntity, "request body failed validation")
+			for _, fe := range verrs {
+				p.Errors = append(p.Errors, newFieldError(fe))
+			}
+			return p
+		}
+
+		// anything other than a struct can't be validated
+		var invalid *validator.InvalidValidationError
+		if !errors.As(err, &invalid) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// WriteProblem writes the given error as a problem details response. If it isn't a *Problem then a generic 500
+// response is written, so that internal errors aren't exposed to clients.
+func WriteProblem(w http.ResponseWriter, err error) error {
+	var p *Problem
+	if !errors.As(err, &p) {
+		p = NewProblem(http.StatusInternalServerError, "")
+	}
+
+	body, err := jsonx.Marshal(p)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(p.Status)
+	_, err = w.Write(body)
+	return err
+}
+
+func newFieldError(fe validator.FieldError) *FieldError {
+	// the namespace is prefixed by the name of the top level type which the client doesn't know about
+	_, path, _ := strings.Cut(fe.Namespace(), ".")
+
+	var message string
+	switch {
+	case fe.Tag() == "required":
+		message = "is required"
+	case fe.Param() != "":
+		message = fmt.Sprintf("failed '%s=%s' validation", fe.Tag(), fe.Param())
+	default:
+		message = fmt.Sprintf("failed '%s' validation", fe.Tag())
+	}
+
+	return &FieldError{Field: path, Tag: fe.Tag(), Message: message}
+}
+
+// describeJSONError describes an unmarshaling error in terms a client can act on
+func describeJSONError(body []byte, err error) string {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+
+	switch {
+	case len(bytes.TrimSpace(body)) == 0:
+		return "request body is empty"
+	case errors.As(err, &syntaxErr):
+		return fmt.Sprintf("malformed JSON at offset %d", syntaxErr.Offset)
+	case errors.As(err, &typeErr):
+		return fmt.Sprintf("invalid value for field '%s', expected %s", typeErr.Field, typeErr.Type)
+	default:
+		return "malformed JSON"
+	}
+}
@@ -0,0 +1,87 @@
+package httpx_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/nyaruka/gocommon/httpx"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodeJSON(t *testing.T) {
+	type contact struct {
+		Name string `json:"name" validate:"required"`
+		URN  string `json:"urn"  validate:"required,startswith=tel:"`
+	}
+	type payload struct {
+		Flow     string     `json:"flow"     validate:"required,uuid"`
+		Contacts []*contact `json:"contacts" validate:"required,max=2,dive"`
+		Extra    int        `json:"-"`
+	}
+
+	decode := func(contentType, body string) (*payload, error) {
+		r := httptest.NewRequest("POST", "/start", strings.NewReader(body))
+		if contentType != "" {
+			r.Header.Set("Content-Type", contentType)
+		}
+		p := &payload{}
+		err := httpx.DecodeJSON(r, p, 100)
+		return p, err
+	}
+
+	p, err := decode("application/json; charset=utf-8", `{"flow": "1be7f6a3-4c8e-4bb4-8bd0-9a8a1c4c6e8c", "contacts": [{"name": "Bob", "urn": "tel:+1234"}]}`)
+	assert.NoError(t, err)
+	assert.Equal(t, "Bob", p.Contacts[0].Name)
+
+	tcs := []struct {
+		contentType string
+		body        string
+		status      int
+		detail      string
+		errors      []*httpx.FieldError
+	}{
+		{"text/plain", `{}`, 415, "expected content type application/json, got 'text/plain'", nil},
+		{"application/json", `{"flow": "` + strings.Repeat("x", 100) + `"}`, 413, "request body exceeds limit of 100 bytes", nil},
+		{"application/json", ``, 400, "request body is empty", nil},
+		{"application/json", `{"flow": }`, 400, "malformed JSON at offset 10", nil},
+		{"application/json", `{"flow": 123}`, 400, "invalid value for field 'flow', expected string", nil},
+		{"application/vnd.api+json", `{"flow": "abc", "contacts": [{"name": "Bob", "urn": "mailto:bob"}, {"urn": "tel:1"}]}`, 422, "request body failed validation", []*httpx.FieldError{
+			{Field: "flow", Tag: "uuid", Message: "failed 'uuid' validation"},
+			{Field: "contacts[0].urn", Tag: "startswith", Message: "failed 'startswith=tel:' validation"},
+			{Field: "contacts[1].name", Tag: "required", Message: "is required"},
+		}},
+	}
+
+	for _, tc := range tcs {
+		_, err := decode(tc.contentType, tc.body)
+
+		var problem *httpx.Problem
+		if assert.ErrorAs(t, err, &problem, "expected problem for body %s", tc.body) {
+			assert.Equal(t, tc.status, problem.Status, "status mismatch for body %s", tc.body)
+			assert.Equal(t, http.StatusText(tc.status), problem.Title)
+			assert.Equal(t, tc.detail, problem.Detail, "detail mismatch for body %s", tc.body)
+			assert.Equal(t, tc.errors, problem.Errors, "errors mismatch for body %s", tc.body)
+		}
+	}
+}
+
+func TestWriteProblem(t *testing.T) {
+	w := httptest.NewRecorder()
+	p := httpx.NewProblem(422, "request body failed validation")
+	p.Errors = []*httpx.FieldError{{Field: "flow", Tag: "required", Message: "is required"}}
+
+	assert.NoError(t, httpx.WriteProblem(w, p))
+	assert.Equal(t, 422, w.Code)
+	assert.Equal(t, "application/problem+json", w.Header().Get("Content-Type"))
+	assert.JSONEq(t, `{"title": "Unprocessable Entity", "status": 422, "detail": "request body failed validation", "errors": [{"field": "flow", "tag": "required", "message": "is required"}]}`, w.Body.String())
+	assert.EqualError(t, p, "Unprocessable Entity: request body failed validation")
+
+	// other errors aren't exposed
+	w = httptest.NewRecorder()
+	assert.NoError(t, httpx.WriteProblem(w, errors.New("database is down")))
+	assert.Equal(t, 500, w.Code)
+	assert.JSONEq(t, `{"title": "Internal Server Error", "status": 500}`, w.Body.String())
+}
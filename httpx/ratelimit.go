@@ -0,0 +1,155 @@
+package httpx
+
+import (
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/nyaruka/gocommon/dates"
+)
+
+// maxRateLimitBuckets is how many keys a rate limiting transport tracks before it starts discarding the buckets of
+// keys which haven't been used recently enough to still be limited
+const maxRateLimitBuckets = 1000
+
+// RateLimitConfig configures client-side rate limiting of requests
+type RateLimitConfig struct {
+	Rate  float64                    // requests per second allowed for each key, where zero means unlimited
+	Burst int                        // number of requests which can be made at once before the rate applies
+	Key   func(*http.Request) string // the key requests are limited by, if nil, HostKey is used
+}
+
+// NewRateLimitConfig creates a new rate limit config which limits requests by host
+func NewRateLimitConfig(rate float64, burst int) *RateLimitConfig {
+	return &RateLimitConfig{Rate: rate, Burst: burst, Key: HostKey}
+}
+
+// HostKey is the default key function for rate limiting which limits requests by host
+func HostKey(r *http.Request) string {
+	return r.URL.Host
+}
+
+// bucket is a token bucket for a single key. Tokens can go negative, which represents requests waiting their turn.
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// rateLimitTransport is an http.RoundTripper which limits the rate of requests per key, delegating to an inner
+// transport. It is safe for concurrent use by multiple goroutines, as the http.RoundTripper contract requires.
+type rateLimitTransport struct {
+	inner   http.RoundTripper
+	config  *RateLimitConfig
+	mutex   sync.Mutex // guards buckets
+	buckets map[string]*bucket
+}
+
+// WithRateLimit wraps an http.RoundTripper so that requests are limited to config.Rate per second for each key
+// given by config.Key, with up to config.Burst requests allowed at once. A request over the limit waits for its
+// turn, giving up with the context's error if the request's context is cancelled first. A nil config or a zero rate
+// makes it a pass-through, so it's always safe to wrap. If inner is nil then http.DefaultTransport is used.
+//
+// Keys are tracked by the transport, so share a single transport between all the clients which call the same API.
+// Compose this inside WithTraces and the time a request spent waiting is recorded as Trace.RateLimitWait:
+//
+//	httpx.WithTraces(httpx.WithRateLimit(inner, limits))
+func WithRateLimit(inner http.RoundTripper, config *RateLimitConfig) http.RoundTripper {
+	if inner == nil {
+		inner = http.DefaultTransport
+	}
+	return &rateLimitTransport{inner: inner, config: config, buckets: make(map[string]*bucket)}
+}
+
+func (t *rateLimitTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	if t.config == nil || t.config.Rate <= 0 {
+		return t.inner.RoundTrip(request)
+	}
+
+	keyFn := t.config.Key
+	if keyFn == nil {
+		keyFn = HostKey
+	}
+
+	key := keyFn(request)
+	delay := t.reserve(key)
+
+	if delay > 0 {
+		start := dates.Now()
+		err := wait(request.Context(), delay)
+
+		// record how long we actually waited, which is less than the delay if we were cancelled
+		if stats := traceStatsFromContext(request.Context()); stats != nil {
+			waited := delay
+			if err != nil {
+				waited = min(dates.Since(start), delay)
+			}
+			stats.rateLimitWait.Add(int64(waited))
+		}
+
+		if err != nil {
+			// give back our place in line so that a cancelled request doesn't slow down those behind it
+			t.cancel(key)
+
+			// the http.RoundTripper contract requires the request body to be closed even on error paths
+			if request.Body != nil {
+				request.Body.Close()
+			}
+			return nil, err
+		}
+	}
+
+	return t.inner.RoundTrip(request)
+}
+
+// reserve takes a token from the bucket for the given key, returning how long the caller must wait before using it
+func (t *rateLimitTransport) reserve(key string) time.Duration {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	now := dates.Now()
+
+	b := t.buckets[key]
+	if b == nil {
+		if len(t.buckets) >= maxRateLimitBuckets {
+			t.prune(now)
+		}
+
+		b = &bucket{tokens: float64(t.config.Burst), updated: now}
+		t.buckets[key] = b
+	}
+
+	b.tokens = t.refill(b, now) - 1
+	b.updated = now
+
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / t.config.Rate * float64(time.Second))
+}
+
+// cancel returns a token reserved for the given key which won't be used
+func (t *rateLimitTransport) cancel(key string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if b := t.buckets[key]; b != nil {
+		b.tokens++
+	}
+}
+
+// refill calculates how many tokens the given bucket has at the given time
+func (t *rateLimitTransport) refill(b *bucket, now time.Time) float64 {
+	return math.Min(b.tokens+now.Sub(b.updated).Seconds()*t.config.Rate, float64(t.config.Burst))
+}
+
+// prune discards the buckets which have refilled, as they're no different to new ones
+func (t *rateLimitTransport) prune(now time.Time) {
+	for key, b := range t.buckets {
+		if t.refill(b, now) >= float64(t.config.Burst) {
+			delete(t.buckets, key)
+		}
+	}
+}
+
+var _ http.RoundTripper = (*rateLimitTransport)(nil)
@@ -0,0 +1,108 @@
+package httpx_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/nyaruka/gocommon/dates"
+	"github.com/nyaruka/gocommon/httpx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithRateLimit(t *testing.T) {
+	ctx := context.Background()
+
+	// the clock doesn't move so buckets only refill when we say so
+	now := time.Date(2019, 10, 7, 15, 21, 30, 0, time.UTC)
+	defer dates.SetNowFunc(time.Now)
+	dates.SetNowFunc(func() time.Time { return now })
+
+	mocks := httpx.WithMocks(nil, map[string][]*httpx.MockResponse{
+		"http://temba.io/*":    {httpx.NewMockResponse(200, nil, nil), httpx.NewMockResponse(200, nil, nil), httpx.NewMockResponse(200, nil, nil)},
+		"http://nyaruka.com/*": {httpx.NewMockResponse(200, nil, nil), httpx.NewMockResponse(200, nil, nil)},
+	})
+
+	// 20 requests per second with a burst of 2
+	transport := httpx.WithTraces(httpx.WithRateLimit(mocks, httpx.NewRateLimitConfig(20, 2)))
+
+	call := func(ctx context.Context, url string) (*httpx.Trace, error) {
+		traceCtx, traces := httpx.WithTraceCollector(ctx)
+		req, err := httpx.NewRequest(traceCtx, "GET", url, nil, nil)
+		require.NoError(t, err)
+		_, err = transport.RoundTrip(req)
+		return traces.Last(), err
+	}
+
+	// first two requests to a host are allowed immediately
+	for range 2 {
+		trace, err := call(ctx, "http://temba.io/")
+		assert.NoError(t, err)
+		assert.Equal(t, time.Duration(0), trace.RateLimitWait)
+	}
+
+	// as are requests to other hosts
+	trace, err := call(ctx, "http://nyaruka.com/")
+	assert.NoError(t, err)
+	assert.Equal(t, time.Duration(0), trace.RateLimitWait)
+
+	// but the third must wait its turn, and how long it waited is recorded on the trace and log
+	trace, err = call(ctx, "http://temba.io/")
+	assert.NoError(t, err)
+	assert.Equal(t, 50*time.Millisecond, trace.RateLimitWait)
+	assert.Equal(t, 50, httpx.NewLog(trace, 2048, 10000, nil).RateLimitWaitMS)
+
+	// once the bucket has refilled, requests are allowed immediately again
+	now = now.Add(time.Second)
+	trace, err = call(ctx, "http://nyaruka.com/")
+	assert.NoError(t, err)
+	assert.Equal(t, time.Duration(0), trace.RateLimitWait)
+	assert.False(t, mocks.HasUnused())
+
+	// a request which is cancelled while waiting gives up, and only the time it actually waited is recorded
+	now = time.Now()
+	mocks = httpx.WithMocks(nil, map[string][]*httpx.MockResponse{"http://temba.io/*": {httpx.NewMockResponse(200, nil, nil)}})
+	transport = httpx.WithTraces(httpx.WithRateLimit(mocks, httpx.NewRateLimitConfig(0.1, 1)))
+	_, err = call(ctx, "http://temba.io/")
+	assert.NoError(t, err)
+
+	dates.SetNowFunc(time.Now)
+
+	cancelCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	trace, err = call(cancelCtx, "http://temba.io/")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.GreaterOrEqual(t, trace.RateLimitWait, 10*time.Millisecond)
+	assert.Less(t, trace.RateLimitWait, 5*time.Second) // rather than the 10 seconds it would have waited
+	assert.False(t, mocks.HasUnused())
+
+	// requests can be limited by a custom key
+	mocks = httpx.WithMocks(nil, map[string][]*httpx.MockResponse{
+		"http://temba.io/*": {httpx.NewMockResponse(200, nil, nil), httpx.NewMockResponse(200, nil, nil)},
+	})
+	transport = httpx.WithRateLimit(mocks, &httpx.RateLimitConfig{Rate: 0.1, Burst: 1, Key: func(r *http.Request) string { return r.Header.Get("Account") }})
+	for _, account := range []string{"1", "2"} {
+		req, _ := httpx.NewRequest(ctx, "GET", "http://temba.io/", nil, map[string]string{"Account": account})
+		_, err = transport.RoundTrip(req)
+		assert.NoError(t, err)
+	}
+
+	// a nil config or a zero rate is a pass-through
+	for _, config := range []*httpx.RateLimitConfig{nil, {}} {
+		mocks = httpx.WithMocks(nil, map[string][]*httpx.MockResponse{"http://temba.io/*": {httpx.NewMockResponse(200, nil, nil), httpx.NewMockResponse(200, nil, nil)}})
+		transport = httpx.WithRateLimit(mocks, config)
+		for range 2 {
+			req, _ := httpx.NewRequest(ctx, "GET", "http://temba.io/", nil, nil)
+			_, err = transport.RoundTrip(req)
+			assert.NoError(t, err)
+		}
+	}
+
+	// a struct literal config without a key function limits by host
+	mocks = httpx.WithMocks(nil, map[string][]*httpx.MockResponse{"http://temba.io/*": {httpx.NewMockResponse(200, nil, nil)}})
+	transport = httpx.WithTraces(httpx.WithRateLimit(mocks, &httpx.RateLimitConfig{Rate: 1, Burst: 1}))
+	_, err = call(ctx, "http://temba.io/")
+	assert.NoError(t, err)
+}
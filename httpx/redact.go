@@ -0,0 +1,239 @@
+package httpx
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// DefaultRedactionMask is the mask used by structured redaction unless a different one is given with RedactMask
+const DefaultRedactionMask = "**********"
+
+// LogOption configures how a log is created from a trace.
+type LogOption func(*logConfig)
+
+// logConfig is the structured redaction applied when creating a log, which masks values that aren't known in advance
+// by where they appear rather than what they are.
+type logConfig struct {
+	mask        string
+	headers     []string
+	queryParams []string
+	formFields  []string
+	jsonPaths   [][]string
+}
+
+// RedactMask sets the mask used to replace values redacted by the other redaction options.
+func RedactMask(mask string) LogOption {
+	return func(c *logConfig) { c.mask = mask }
+}
+
+// RedactHeaders masks the values of the given request and response headers, e.g. Authorization. Names are case
+// insensitive.
+func RedactHeaders(names ...string) LogOption {
+	return func(c *logConfig) { c.headers = append(c.headers, names...) }
+}
+
+// RedactQueryParams masks the values of the given query parameters in the URL, e.g. access_token.
+func RedactQueryParams(names ...string) LogOption {
+	return func(c *logConfig) { c.queryParams = append(c.queryParams, names...) }
+}
+
+// RedactFormFields masks the values of the given fields in form encoded request and response bodies.
+func RedactFormFields(names ...string) LogOption {
+	return func(c *logConfig) { c.formFields = append(c.formFields, names...) }
+}
+
+// RedactJSONPaths masks the values at the given paths in JSON request and response bodies. Paths are dot separated
+// keys or array indexes, with * matching any single key or index, e.g. "password", "user.token" or "items.*.pin".
+func RedactJSONPaths(paths ...string) LogOption {
+	return func(c *logConfig) {
+		for _, p := range paths {
+			c.jsonPaths = append(c.jsonPaths, strings.Split(p, "."))
+		}
+	}
+}
+
+func newLogConfig(opts []LogOption) *logConfig {
+	c := &logConfig{mask: DefaultRedactionMask}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// redactURL masks query parameters in the given URL
+func (c *logConfig) redactURL(u string) string {
+	if len(c.queryParams) == 0 {
+		return u
+	}
+	base, query, found := strings.Cut(u, "?")
+	if !found {
+		return u
+	}
+	return base + "?" + redactEncoded(query, c.queryParams, c.mask)
+}
+
+// redactTrace masks headers, the URL in the request line if it's a request, and the body of the given sanitized
+// request or response trace
+func (c *logConfig) redactTrace(trace string, contentType string, isRequest bool) string {
+	head, body, found := strings.Cut(trace, "\r\n\r\n")
+
+	lines := strings.Split(head, "\r\n")
+	for i, line := range lines {
+		if i == 0 {
+			if !isRequest {
+				continue
+			}
+			// the request line, e.g. GET /foo?bar=1 HTTP/1.1
+			if method, rest, ok := strings.Cut(line, " "); ok {
+				if target, proto, ok := strings.Cut(rest, " "); ok {
+					lines[i] = method + " " + c.redactURL(target) + " " + proto
+				}
+			}
+		} else if name, _, ok := strings.Cut(line, ":"); ok && slices.ContainsFunc(c.headers, func(h string) bool { return strings.EqualFold(h, name) }) {
+			lines[i] = name + ": " + c.mask
+		}
+	}
+	head = strings.Join(lines, "\r\n")
+
+	if !found {
+		return head
+	}
+	return head + "\r\n\r\n" + c.redactBody(body, contentType)
+}
+
+// redactBody masks form fields or JSON values in the given body according to its content type
+func (c *logConfig) redactBody(body string, contentType string) string {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+
+	if mediaType == "application/x-www-form-urlencoded" && len(c.formFields) > 0 {
+		return redactEncoded(body, c.formFields, c.mask)
+	}
+	if (mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")) && len(c.jsonPaths) > 0 {
+		return string(redactJSON([]byte(body), c.jsonPaths, c.mask))
+	}
+	return body
+}
+
+// redactEncoded masks the values of the given keys in a URL encoded query or form, preserving everything else as is
+func redactEncoded(encoded string, keys []string, mask string) string {
+	pairs := strings.Split(encoded, "&")
+	for i, pair := range pairs {
+		key, _, _ := strings.Cut(pair, "=")
+		if unescaped, err := url.QueryUnescape(key); err == nil && slices.Contains(keys, unescaped) {
+			pairs[i] = key + "=" + mask
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// redactJSON masks the values at the given paths in a JSON document, leaving the rest of the document byte for byte
+// as it was. If the document is invalid, e.g. because it was cut short by a capture limit, it's redacted up to the
+// last token which could be parsed and everything after that is masked, as it may be part of a value to redact.
+func redactJSON(data []byte, paths [][]string, mask string) []byte {
+	if len(bytes.TrimSpace(data)) == 0 {
+		return data
+	}
+
+	r := &jsonRedactor{dec: json.NewDecoder(bytes.NewReader(data)), data: data, paths: paths}
+	err := r.value(nil)
+
+	// the offset is the end of the last token successfully read, and anything after that besides whitespace is invalid
+	parsed := int(r.dec.InputOffset())
+	invalid := err != nil || len(bytes.TrimSpace(data[parsed:])) > 0
+
+	maskJSON, _ := json.Marshal(mask)
+
+	// spans are recorded innermost first, so sort them by position and skip any inside one we've already masked
+	slices.SortFunc(r.spans, func(a, b [2]int) int { return a[0] - b[0] })
+
+	out := &bytes.Buffer{}
+	pos := 0
+	for _, span := range r.spans {
+		if span[0] < pos {
+			continue
+		}
+		out.Write(data[pos:span[0]])
+		out.Write(maskJSON)
+		pos = span[1]
+	}
+
+	if invalid {
+		// keep any separators after the last token so it's clear where the mask starts
+		for parsed < len(data) && strings.IndexByte(" \t\r\n:,", data[parsed]) >= 0 {
+			parsed++
+		}
+		out.Write(data[pos:parsed])
+		out.WriteString(mask)
+	} else {
+		out.Write(data[pos:])
+	}
+	return out.Bytes()
+}
+
+type jsonRedactor struct {
+	dec   *json.Decoder
+	data  []byte
+	paths [][]string
+	spans [][2]int
+}
+
+// value reads the next value from the decoder, recording its span if it's at one of our paths
+func (r *jsonRedactor) value(path []string) error {
+	// the decoder's offset is just past the previous token, so skip any separators to find the start of this value
+	start := int(r.dec.InputOffset())
+	for start < len(r.data) && strings.IndexByte(" \t\r\n:,", r.data[start]) >= 0 {
+		start++
+	}
+
+	tok, err := r.dec.Token()
+	if err != nil {
+		return err
+	}
+
+	switch tok {
+	case json.Delim('{'):
+		for r.dec.More() {
+			key, err := r.dec.Token()
+			if err != nil {
+				return err
+			}
+			if err := r.value(append(slices.Clip(path), key.(string))); err != nil {
+				return err
+			}
+		}
+		if _, err := r.dec.Token(); err != nil {
+			return err
+		}
+	case json.Delim('['):
+		for i := 0; r.dec.More(); i++ {
+			if err := r.value(append(slices.Clip(path), strconv.Itoa(i))); err != nil {
+				return err
+			}
+		}
+		if _, err := r.dec.Token(); err != nil {
+			return err
+		}
+	}
+
+	if path != nil && slices.ContainsFunc(r.paths, func(p []string) bool { return jsonPathMatches(p, path) }) {
+		r.spans = append(r.spans, [2]int{start, int(r.dec.InputOffset())})
+	}
+	return nil
+}
+
+func jsonPathMatches(pattern, path []string) bool {
+	if len(pattern) != len(path) {
+		return false
+	}
+	for i := range pattern {
+		if pattern[i] != "*" && pattern[i] != path[i] {
+			return false
+		}
+	}
+	return true
+}
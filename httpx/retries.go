@@ -6,7 +6,7 @@ import (
 	"io"
 	"net/http"
 	"strconv"
-	"sync/atomic"
+	"sync"
 	"time"
 
 	"github.com/nyaruka/gocommon/dates"
@@ -18,6 +18,13 @@ type RetryConfig struct {
 	Backoffs    []time.Duration
 	Jitter      float64
 	ShouldRetry func(*http.Request, *http.Response, time.Duration) bool
+
+	// if set, limits retries across all the requests made with this config
+	Budget *RetryBudget
+
+	// if non-zero, a Retry-After longer than the backoff is waited for as long as it's no more than this, and a longer
+	// one stops retrying rather than tying up the caller
+	MaxRetryAfter time.Duration
 }
 
 // NewFixedRetries creates a new retry config with the given backoffs
@@ -100,6 +107,73 @@ func ParseRetryAfter(value string) time.Duration {
 	return 0
 }
 
+// number of buckets in a retry budget's sliding window
+const retryBudgetBuckets = 10
+
+// RetryBudget limits retries to a ratio of requests over a sliding window, so that when a service is failing, requests
+// to it don't all retry and multiply the load on it. A budget is shared by every transport using the config it's part
+// of, and is safe for concurrent use by multiple goroutines.
+type RetryBudget struct {
+	Ratio      float64       // max ratio of retries to requests, e.g. 0.2 allows 1 retry for every 5 requests
+	Window     time.Duration // period over which requests and retries are counted
+	MinRetries int           // number of retries always allowed per window, so that a quiet service can still retry
+
+	mutex   sync.Mutex // guards the rest
+	buckets [retryBudgetBuckets]retryBudgetBucket
+}
+
+type retryBudgetBucket struct {
+	start    time.Time
+	requests int
+	retries  int
+}
+
+// NewRetryBudget creates a new retry budget
+func NewRetryBudget(ratio float64, window time.Duration, minRetries int) *RetryBudget {
+	return &RetryBudget{Ratio: ratio, Window: window, MinRetries: minRetries}
+}
+
+// bucket returns the current bucket, resetting it if its last use was outside of the window
+func (b *RetryBudget) bucket(now time.Time) *retryBudgetBucket {
+	size := max(b.Window/retryBudgetBuckets, 1)
+	start := now.Truncate(size)
+	bucket := &b.buckets[(start.UnixNano()/int64(size))%retryBudgetBuckets]
+	if !bucket.start.Equal(start) {
+		*bucket = retryBudgetBucket{start: start}
+	}
+	return bucket
+}
+
+// recordRequest records that a request was made
+func (b *RetryBudget) recordRequest() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.bucket(dates.Now()).requests++
+}
+
+// tryRetry records a retry if the budget allows it, returning whether it did
+func (b *RetryBudget) tryRetry() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	now := dates.Now()
+	requests, retries := 0, 0
+	for _, bucket := range b.buckets {
+		if now.Sub(bucket.start) < b.Window {
+			requests += bucket.requests
+			retries += bucket.retries
+		}
+	}
+
+	if retries >= b.MinRetries && float64(retries+1) > b.Ratio*float64(requests) {
+		return false
+	}
+
+	b.bucket(now).retries++
+	return true
+}
+
 // maxRetryDrain caps how many bytes of a to-be-discarded response body we drain before retrying. Draining lets the
 // underlying connection be reused, but an unbounded drain of a large or slow error body could cost more than the
 // reuse it buys, so we bound it to the same size net/http.Transport uses for the same purpose.
@@ -118,6 +192,9 @@ type retryTransport struct {
 // try and, if so, waits the configured backoff before retrying. A nil config makes it a pass-through, so it's always
 // safe to wrap. If inner is nil then http.DefaultTransport is used.
 //
+// If the config has a budget then a request is only retried while the budget allows, and if it has a max Retry-After
+// then a response's Retry-After is waited for instead of the backoff when longer, up to that max.
+//
 // A request with a body is only retried if the body can be rewound, i.e. it has a non-nil GetBody (which
 // http.NewRequest populates automatically for the common in-memory body types). This mirrors how net/http.Transport
 // itself decides whether a request is replayable (see https://github.com/golang/go/issues/18241). Between attempts
@@ -139,8 +216,12 @@ func WithRetries(inner http.RoundTripper, retries *RetryConfig) http.RoundTrippe
 }
 
 func (t *retryTransport) RoundTrip(request *http.Request) (*http.Response, error) {
-	// an outer traces transport may have installed a counter for us to report retries through
-	count := retryCountFromContext(request.Context())
+	// an outer traces transport may have installed stats for us to report retries through
+	stats := traceStatsFromContext(request.Context())
+
+	if t.retries != nil && t.retries.Budget != nil {
+		t.retries.Budget.recordRequest()
+	}
 
 	retry := 0
 	for {
@@ -152,6 +233,16 @@ func (t *retryTransport) RoundTrip(request *http.Request) (*http.Response, error
 		}
 
 		backoff := t.retries.Backoff(retry)
+
+		// honour a longer Retry-After if we've been configured to, but give up if it's longer than we're willing to wait
+		if response != nil && t.retries.MaxRetryAfter > 0 {
+			if retryAfter := ParseRetryAfter(response.Header.Get("Retry-After")); retryAfter > t.retries.MaxRetryAfter {
+				return response, err
+			} else if retryAfter > backoff {
+				backoff = retryAfter
+			}
+		}
+
 		if !t.retries.ShouldRetry(request, response, backoff) {
 			return response, err
 		}
@@ -163,6 +254,11 @@ func (t *retryTransport) RoundTrip(request *http.Request) (*http.Response, error
 			return response, err
 		}
 
+		// and finally check we haven't used up the retry budget
+		if t.retries.Budget != nil && !t.retries.Budget.tryRetry() {
+			return response, err
+		}
+
 		// drain and close the response we're discarding so the underlying connection can be reused; cap the drain
 		// (as net/http.Transport does) so a large or slow error body doesn't cost more than the reuse it buys
 		if response != nil {
@@ -187,8 +283,8 @@ func (t *retryTransport) RoundTrip(request *http.Request) (*http.Response, error
 		}
 
 		retry++
-		if count != nil {
-			count.Add(1)
+		if stats != nil {
+			stats.retries.Add(1)
 		}
 	}
 }
@@ -213,21 +309,3 @@ func wait(ctx context.Context, d time.Duration) error {
 		return nil
 	}
 }
-
-// retryCountKey is the unexported context key under which a retry counter is carried so that an outer traces
-// transport can recover how many retries an inner retryTransport performed. See WithRetries.
-type retryCountKey struct{}
-
-// contextWithRetryCount returns a copy of ctx carrying a fresh retry counter, along with that counter. An outer
-// transport (e.g. the one built by WithTraces) installs this before delegating so that an inner retryTransport can
-// record how many retries it made and the outer transport can read the count back when finalizing its trace.
-func contextWithRetryCount(ctx context.Context) (context.Context, *atomic.Int64) {
-	count := &atomic.Int64{}
-	return context.WithValue(ctx, retryCountKey{}, count), count
-}
-
-// retryCountFromContext returns the retry counter carried in ctx, or nil if none was installed.
-func retryCountFromContext(ctx context.Context) *atomic.Int64 {
-	count, _ := ctx.Value(retryCountKey{}).(*atomic.Int64)
-	return count
-}
@@ -327,3 +327,82 @@ func TestWithRetriesNilInner(t *testing.T) {
 	resp.Body.Close()
 	assert.Equal(t, `{ "ok": "true" }`, string(body))
 }
+
+func TestWithRetriesMaxRetryAfter(t *testing.T) {
+	ctx := context.Background()
+
+	defer dates.SetNowFunc(time.Now)
+	now := time.Date(2020, 1, 7, 15, 10, 30, 950000000, time.UTC)
+	dates.SetNowFunc(dates.NewFixedNow(now))
+
+	retries := httpx.NewFixedRetries(time.Millisecond)
+	retries.MaxRetryAfter = 100 * time.Millisecond
+
+	// a Retry-After longer than the backoff but within the max is waited for
+	retryAfter := now.Add(50 * time.Millisecond).UTC().Format(http.TimeFormat)
+	inner := &recordingTransport{steps: []recordedStep{
+		{status: 429, headers: map[string]string{"Retry-After": retryAfter}, body: "slow down"},
+		{status: 200, body: "ok"},
+	}}
+	req, _ := httpx.NewRequest(ctx, "GET", "http://temba.io/", nil, nil)
+	start := time.Now()
+	resp, err := httpx.WithRetries(inner, retries).RoundTrip(req)
+	require.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, 2, inner.calls)
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+
+	// a Retry-After longer than the max stops retrying, even for a response we'd otherwise retry
+	inner = &recordingTransport{steps: []recordedStep{
+		{status: 503, headers: map[string]string{"Retry-After": "3600"}, body: "come back later"},
+		{status: 200, body: "ok"},
+	}}
+	req, _ = httpx.NewRequest(ctx, "GET", "http://temba.io/", nil, nil)
+	resp, err = httpx.WithRetries(inner, retries).RoundTrip(req)
+	require.NoError(t, err)
+	assert.Equal(t, 503, resp.StatusCode)
+	assert.Equal(t, 1, inner.calls)
+}
+
+func TestRetryBudget(t *testing.T) {
+	ctx := context.Background()
+
+	defer dates.SetNowFunc(time.Now)
+	now := time.Date(2020, 1, 7, 15, 10, 30, 0, time.UTC)
+	dates.SetNowFunc(func() time.Time { return now })
+
+	// retries limited to 20% of requests per minute, but always allowing 1
+	retries := httpx.NewFixedRetries(time.Millisecond)
+	retries.Budget = httpx.NewRetryBudget(0.2, time.Minute, 1)
+
+	calls := 0
+	inner := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		calls++
+		return &http.Response{StatusCode: 503, Body: io.NopCloser(strings.NewReader("")), Request: r}, nil
+	})
+
+	// budget is shared by all transports using the config
+	transports := []http.RoundTripper{httpx.WithRetries(inner, retries), httpx.WithRetries(inner, retries)}
+
+	do := func(n int) {
+		for i := range n {
+			req, _ := httpx.NewRequest(ctx, "GET", "http://temba.io/", nil, nil)
+			_, err := transports[i%2].RoundTrip(req)
+			require.NoError(t, err)
+		}
+	}
+
+	do(1)
+	assert.Equal(t, 2, calls) // first retry allowed by the minimum
+
+	do(8)
+	assert.Equal(t, 10, calls) // no more retries until 10 requests have been made
+
+	do(1)
+	assert.Equal(t, 12, calls) // 2 retries in 10 requests is within 20%
+
+	// once the window has passed, we're back to the minimum
+	now = now.Add(time.Minute)
+	do(2)
+	assert.Equal(t, 15, calls)
+}
@@ -0,0 +1,193 @@
+package httpx
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nyaruka/gocommon/dates"
+)
+
+// DefaultSigningMaxBodySize is the largest request body which is verified unless a config has its own limit
+const DefaultSigningMaxBodySize = 1024 * 1024 // 1MB
+
+// SignatureError is returned when a request's signature can't be verified
+type SignatureError struct {
+	Reason string
+}
+
+func (e *SignatureError) Error() string {
+	return "invalid request signature: " + e.Reason
+}
+
+// SigningConfig configures how requests are signed and verified. The signature is a hex encoded HMAC-SHA256 of the
+// timestamp, a period and the request body, e.g. HMAC("1700000000.{"foo":"bar"}"), prefixed with "sha256=".
+type SigningConfig struct {
+	Secret          []byte
+	Header          string        // header which holds the signature
+	TimestampHeader string        // header which holds the unix timestamp of when the request was signed
+	ReplayWindow    time.Duration // how far a timestamp can be from now and still be accepted when verifying
+	MaxBodySize     int64         // largest body read when verifying, if zero DefaultSigningMaxBodySize is used
+}
+
+// NewSigningConfig creates a new signing config with the given secret and the default headers and replay window
+func NewSigningConfig(secret []byte) *SigningConfig {
+	return &SigningConfig{
+		Secret:          secret,
+		Header:          "X-Signature",
+		TimestampHeader: "X-Signature-Timestamp",
+		ReplayWindow:    5 * time.Minute,
+		MaxBodySize:     DefaultSigningMaxBodySize,
+	}
+}
+
+// Sign returns the signature of the given body at the given time
+func (c *SigningConfig) Sign(timestamp time.Time, body []byte) string {
+	mac := hmac.New(sha256.New, c.Secret)
+	mac.Write([]byte(strconv.FormatInt(timestamp.Unix(), 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks the signature and timestamp headers of the given request, returning a *SignatureError if they're
+// missing, don't match the body, or the timestamp is outside of the replay window. The request body is read and
+// replaced so that it can still be read by the handler, unless it's larger than the config's max body size, in which
+// case the returned error wraps an *http.MaxBytesError.
+func (c *SigningConfig) Verify(request *http.Request) error {
+	signature := request.Header.Get(c.Header)
+	if signature == "" {
+		return &SignatureError{Reason: fmt.Sprintf("missing %s header", c.Header)}
+	}
+	ts, err := strconv.ParseInt(request.Header.Get(c.TimestampHeader), 10, 64)
+	if err != nil {
+		return &SignatureError{Reason: fmt.Sprintf("missing or invalid %s header", c.TimestampHeader)}
+	}
+
+	timestamp := time.Unix(ts, 0)
+	if age := dates.Since(timestamp); age > c.ReplayWindow || age < -c.ReplayWindow {
+		return &SignatureError{Reason: fmt.Sprintf("timestamp %d is outside of replay window", ts)}
+	}
+
+	body, err := readAndRestoreBody(request, c.maxBodySize())
+	if err != nil {
+		return fmt.Errorf("error reading request body: %w", err)
+	}
+
+	if !hmac.Equal([]byte(strings.ToLower(signature)), []byte(c.Sign(timestamp, body))) {
+		return &SignatureError{Reason: "signature doesn't match"}
+	}
+	return nil
+}
+
+// signingTransport is an http.RoundTripper which signs requests before delegating to an inner transport
+type signingTransport struct {
+	inner  http.RoundTripper
+	config *SigningConfig
+}
+
+// WithSigning wraps an http.RoundTripper so that requests are signed with the given config, setting the signature and
+// timestamp headers. Requests are signed each time they're sent, so compose this inside WithRetries for retries to
+// get fresh timestamps. A nil config makes it a pass-through, so it's always safe to wrap. If inner is nil then
+// http.DefaultTransport is used.
+func WithSigning(inner http.RoundTripper, config *SigningConfig) http.RoundTripper {
+	if inner == nil {
+		inner = http.DefaultTransport
+	}
+	return &signingTransport{inner: inner, config: config}
+}
+
+func (t *signingTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	if t.config == nil {
+		return t.inner.RoundTrip(request)
+	}
+
+	// a round tripper shouldn't modify the request it's given
+	signed := request.Clone(request.Context())
+
+	body, err := readAndRestoreBody(signed, 0)
+	if err != nil {
+		return nil, fmt.Errorf("error reading request body: %w", err)
+	}
+
+	now := dates.Now()
+	signed.Header.Set(t.config.Header, t.config.Sign(now, body))
+	signed.Header.Set(t.config.TimestampHeader, strconv.FormatInt(now.Unix(), 10))
+
+	return t.inner.RoundTrip(signed)
+}
+
+// VerifySigning returns middleware which rejects requests whose signatures can't be verified with the given config
+// with a 401 response. Each rejected request is recorded with a Recorder and its trace passed to onFailure (which
+// may be nil), along with the reason, so that it can be logged. Requests with bodies larger than the config's max body
+// size are rejected with a 413 response without being recorded.
+func VerifySigning(config *SigningConfig, onFailure func(*Trace, error)) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// record the request before verification reads the body, but don't read more of it than we'll verify
+			r.Body = http.MaxBytesReader(w, r.Body, config.maxBodySize())
+
+			recorder, err := NewRecorder(r, w, true)
+			if err != nil {
+				if mbe := (*http.MaxBytesError)(nil); errors.As(err, &mbe) {
+					http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+				} else {
+					http.Error(w, "unable to read request", http.StatusBadRequest)
+				}
+				return
+			}
+
+			if err := config.Verify(r); err != nil {
+				http.Error(recorder.ResponseWriter, "invalid signature", http.StatusUnauthorized)
+
+				if onFailure != nil && recorder.End() == nil {
+					onFailure(recorder.Trace, err)
+				}
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func (c *SigningConfig) maxBodySize() int64 {
+	if c.MaxBodySize > 0 {
+		return c.MaxBodySize
+	}
+	return DefaultSigningMaxBodySize
+}
+
+// readAndRestoreBody reads the body of the given request and replaces it so that it can be read again. If limit is
+// greater than zero then a body larger than that is an *http.MaxBytesError.
+func readAndRestoreBody(request *http.Request, limit int64) ([]byte, error) {
+	if request.Body == nil || request.Body == http.NoBody {
+		return nil, nil
+	}
+
+	reader := io.Reader(request.Body)
+	if limit > 0 {
+		reader = io.LimitReader(request.Body, limit+1)
+	}
+
+	body, err := io.ReadAll(reader)
+	request.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if limit > 0 && int64(len(body)) > limit {
+		return nil, &http.MaxBytesError{Limit: limit}
+	}
+
+	request.Body = io.NopCloser(bytes.NewReader(body))
+	request.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(body)), nil }
+	return body, nil
+}
@@ -0,0 +1,112 @@
+package httpx_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nyaruka/gocommon/dates"
+	"github.com/nyaruka/gocommon/httpx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSigning(t *testing.T) {
+	defer dates.SetNowFunc(time.Now)
+	dates.SetNowFunc(dates.NewFixedNow(time.Date(2024, 11, 14, 22, 13, 20, 0, time.UTC)))
+
+	config := httpx.NewSigningConfig([]byte("sesame"))
+	config.MaxBodySize = 100
+
+	assert.Equal(t, "sha256=fe94f3dfbb1c3576035112dce4e762258fdaad1e43dad4001a537116f0575935", config.Sign(dates.Now(), []byte(`{"foo":"bar"}`)))
+
+	var failures []error
+	var failedTraces []*httpx.Trace
+	var handledBody string
+
+	handler := httpx.VerifySigning(config, func(trace *httpx.Trace, err error) {
+		failedTraces = append(failedTraces, trace)
+		failures = append(failures, err)
+	})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		handledBody = string(b)
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	send := func(transport http.RoundTripper, body string, headers map[string]string) *http.Response {
+		request, err := httpx.NewRequest(context.Background(), "POST", server.URL, strings.NewReader(body), headers)
+		require.NoError(t, err)
+		response, err := transport.RoundTrip(request)
+		require.NoError(t, err)
+		response.Body.Close()
+		return response
+	}
+
+	// a correctly signed request is passed to the handler with its body intact
+	resp := send(httpx.WithSigning(nil, config), `{"foo":"bar"}`, nil)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, `{"foo":"bar"}`, handledBody)
+	assert.Len(t, failures, 0)
+
+	// signed with the wrong secret
+	resp = send(httpx.WithSigning(nil, httpx.NewSigningConfig([]byte("wrong"))), `{"foo":"bar"}`, nil)
+	assert.Equal(t, 401, resp.StatusCode)
+
+	// not signed at all, as a nil config is a pass-through
+	resp = send(httpx.WithSigning(nil, nil), `{"foo":"bar"}`, nil)
+	assert.Equal(t, 401, resp.StatusCode)
+
+	// body doesn't match the signature
+	resp = send(http.DefaultTransport, `{"foo":"baz"}`, map[string]string{
+		"X-Signature":           config.Sign(dates.Now(), []byte(`{"foo":"bar"}`)),
+		"X-Signature-Timestamp": "1731622400",
+	})
+	assert.Equal(t, 401, resp.StatusCode)
+
+	// replayed outside of the window
+	old := dates.Now().Add(-10 * time.Minute)
+	resp = send(http.DefaultTransport, `{"foo":"bar"}`, map[string]string{
+		"X-Signature":           config.Sign(old, []byte(`{"foo":"bar"}`)),
+		"X-Signature-Timestamp": "1731621800",
+	})
+	assert.Equal(t, 401, resp.StatusCode)
+
+	if assert.Len(t, failures, 4) {
+		assert.EqualError(t, failures[0], "invalid request signature: signature doesn't match")
+		assert.EqualError(t, failures[1], "invalid request signature: missing X-Signature header")
+		assert.EqualError(t, failures[2], "invalid request signature: signature doesn't match")
+		assert.EqualError(t, failures[3], "invalid request signature: timestamp 1731621800 is outside of replay window")
+
+		var sigErr *httpx.SignatureError
+		assert.True(t, errors.As(failures[0], &sigErr))
+
+		// failures are recorded so they can be logged
+		assert.Contains(t, string(failedTraces[2].RequestTrace), `{"foo":"baz"}`)
+		assert.Equal(t, 401, failedTraces[2].Response.StatusCode)
+		assert.Equal(t, "invalid signature\n", string(failedTraces[2].ResponseBody))
+	}
+
+	// a body larger than the limit is rejected before it's recorded or verified, even if correctly signed
+	resp = send(httpx.WithSigning(nil, config), strings.Repeat("x", 101), nil)
+	assert.Equal(t, 413, resp.StatusCode)
+	assert.Len(t, failures, 4)
+
+	resp = send(httpx.WithSigning(nil, config), strings.Repeat("x", 100), nil)
+	assert.Equal(t, 200, resp.StatusCode)
+
+	// and verifying directly applies the same limit
+	request := httptest.NewRequest("POST", "/", strings.NewReader(strings.Repeat("x", 101)))
+	request.Header.Set("X-Signature", config.Sign(dates.Now(), []byte(strings.Repeat("x", 101))))
+	request.Header.Set("X-Signature-Timestamp", "1731622400")
+
+	var maxBytesErr *http.MaxBytesError
+	assert.ErrorAs(t, config.Verify(request), &maxBytesErr)
+}
@@ -0,0 +1,91 @@
+package httpx
+
+import (
+	"crypto/tls"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// TraceTimings is a breakdown of where the time of a request went. Where a request was retried, it describes the
+// final attempt.
+type TraceTimings struct {
+	DNS        time.Duration `json:"dns"`         // time spent resolving the host
+	Connect    time.Duration `json:"connect"`     // time spent making the TCP connection
+	TLS        time.Duration `json:"tls"`         // time spent on the TLS handshake
+	FirstByte  time.Duration `json:"first_byte"`  // time from starting to get a connection to the first byte of the response
+	ConnReused bool          `json:"conn_reused"` // whether an idle connection was reused, in which case there was no DNS, connect or TLS
+}
+
+// timingsRecorder records timings from the hooks of a httptrace.ClientTrace. Hooks can be called from different
+// goroutines (e.g. when dialing several addresses at once) so access is synchronized.
+type timingsRecorder struct {
+	mutex      sync.Mutex
+	getConn    time.Time
+	dnsStart   time.Time
+	connStart  time.Time
+	tlsStart   time.Time
+	timings    TraceTimings
+	firstByte  bool
+	hasTimings bool
+}
+
+// clientTrace returns the client trace whose hooks record into this recorder
+func (r *timingsRecorder) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		GetConn: func(string) {
+			r.record(func(now time.Time) {
+				// a new attempt resets everything so that we describe the final attempt
+				r.getConn = now
+				r.timings = TraceTimings{}
+				r.firstByte = false
+				r.hasTimings = true
+			})
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			r.record(func(time.Time) { r.timings.ConnReused = info.Reused })
+		},
+		DNSStart: func(httptrace.DNSStartInfo) { r.record(func(now time.Time) { r.dnsStart = now }) },
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			r.record(func(now time.Time) { r.timings.DNS = now.Sub(r.dnsStart) })
+		},
+		ConnectStart: func(string, string) { r.record(func(now time.Time) { r.connStart = now }) },
+		ConnectDone: func(string, string, error) {
+			r.record(func(now time.Time) { r.timings.Connect = now.Sub(r.connStart) })
+		},
+		TLSHandshakeStart: func() { r.record(func(now time.Time) { r.tlsStart = now }) },
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			r.record(func(now time.Time) { r.timings.TLS = now.Sub(r.tlsStart) })
+		},
+		GotFirstResponseByte: func() {
+			r.record(func(now time.Time) {
+				if !r.firstByte {
+					r.timings.FirstByte = now.Sub(r.getConn)
+					r.firstByte = true
+				}
+			})
+		},
+	}
+}
+
+func (r *timingsRecorder) record(fn func(time.Time)) {
+	now := time.Now()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	fn(now)
+}
+
+// result returns the recorded timings or nil if no connection was ever requested, e.g. because the request was
+// answered by a mock or cache
+func (r *timingsRecorder) result() *TraceTimings {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if !r.hasTimings {
+		return nil
+	}
+	t := r.timings
+	return &t
+}
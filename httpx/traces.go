@@ -1,15 +1,21 @@
 package httpx
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/http/httptrace"
 	"net/http/httputil"
+	"net/url"
 	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 	"unicode/utf8"
 
@@ -26,6 +32,14 @@ type Trace struct {
 	StartTime     time.Time
 	EndTime       time.Time
 	Retries       int
+	CircuitOpen   bool          // request was refused by a circuit breaker without being sent
+	RateLimitWait time.Duration // time spent waiting for a rate limiter before the request could be sent
+	Timings       *TraceTimings // breakdown of the request's time, nil if it never needed a connection
+	Cache         CacheStatus   // how the request was handled by a caching transport, empty if it wasn't
+
+	// number of body bytes which were sent or received but not captured because of a capture limit
+	requestUncaptured  int
+	responseUncaptured int
 }
 
 func (t *Trace) String() string {
@@ -38,17 +52,19 @@ func (t *Trace) String() string {
 	return b.String()
 }
 
-// RequestSize returns the size in bytes of the request (headers and body).
+// RequestSize returns the size in bytes of the request (headers and body), including any part of the body which
+// wasn't captured because of a capture limit.
 func (t *Trace) RequestSize() int {
-	return len(t.RequestTrace)
+	return len(t.RequestTrace) + t.requestUncaptured
 }
 
 // ResponseSize returns the size in bytes of the response (headers and body). If the body was discarded by the caller
 // (e.g. because reading it exceeded a limit set with WithReadLimit and failed with ErrResponseSize) then the server
 // declared Content-Length, if any, is used as the best available record of its true size. Chunked or decompressed
-// responses declare no length and so will under-report.
+// responses declare no length and so will under-report. Any part of the body which was read but not captured
+// because of a capture limit is included.
 func (t *Trace) ResponseSize() int {
-	bodySize := len(t.ResponseBody)
+	bodySize := len(t.ResponseBody) + t.responseUncaptured
 	if t.ResponseBody == nil && t.Response != nil && t.Response.ContentLength > 0 {
 		bodySize = int(t.Response.ContentLength)
 	}
@@ -57,6 +73,7 @@ func (t *Trace) ResponseSize() int {
 
 // SanitizedRequest returns a valid UTF-8 string version of the request, substituting the body with a placeholder
 // if it isn't valid UTF-8. It also strips any NULL characters as not all external dependencies can handle those.
+// A body with a Content-Encoding that can be decoded (see DecodeContent) is decoded first.
 func (t *Trace) SanitizedRequest(placeholder string) string {
 	// split request trace into headers and body
 	var headers, body []byte
@@ -68,14 +85,22 @@ func (t *Trace) SanitizedRequest(placeholder string) string {
 	} else {
 		body = nil
 	}
+	if t.Request != nil {
+		body = decodedBody(body, t.Request.Header)
+	}
 
 	return santizedTrace(headers, body, placeholder)
 }
 
 // SanitizedResponse returns a valid UTF-8 string version of the response, substituting the body with a placeholder
 // if it isn't valid UTF-8. It also strips any NULL characters as not all external dependencies can handle those.
+// A body with a Content-Encoding that can be decoded (see DecodeContent) is decoded first.
 func (t *Trace) SanitizedResponse(placeholder string) string {
-	return santizedTrace(t.ResponseTrace, t.ResponseBody, placeholder)
+	body := t.ResponseBody
+	if t.Response != nil {
+		body = decodedBody(body, t.Response.Header)
+	}
+	return santizedTrace(t.ResponseTrace, body, placeholder)
 }
 
 func santizedTrace(header []byte, body []byte, bodyPlaceHolder string) string {
@@ -100,27 +125,48 @@ func replaceNullChars(b []byte) []byte {
 
 // tracesTransport is an http.RoundTripper which captures a Trace of each request and response into the
 // TraceCollector carried by that request's context, delegating to an inner transport. The response body is buffered
-// so that it remains readable by the caller. It holds no state of its own and is safe for concurrent use by multiple
-// goroutines, as the http.RoundTripper contract requires.
+// so that it remains readable by the caller, unless a capture limit is set in which case bodies are streamed. It
+// holds no mutable state of its own and is safe for concurrent use by multiple goroutines, as the
+// http.RoundTripper contract requires.
 type tracesTransport struct {
-	inner http.RoundTripper
+	inner        http.RoundTripper
+	captureLimit int
+}
+
+// TraceOption configures a tracing transport created with WithTraces.
+type TraceOption func(*tracesTransport)
+
+// TraceCaptureLimit makes a tracing transport capture only the first n bytes of each request and response body into
+// its traces. Bodies are then streamed rather than buffered, so tracing a large download doesn't hold it all in
+// memory. The true sizes of the bodies are still recorded and reported by Trace.RequestSize and Trace.ResponseSize.
+//
+// Because the response body is streamed to the caller, its trace can't be complete until the caller is done with it,
+// so the trace is only added to the collector once the body has been read to the end or closed. A value <= 0
+// disables the limit.
+func TraceCaptureLimit(n int) TraceOption {
+	return func(t *tracesTransport) { t.captureLimit = n }
 }
 
 // WithTraces wraps an http.RoundTripper so that each request whose context carries a TraceCollector (see
 // WithTraceCollector) has its request and response captured into that collector as a *Trace. The response body is
 // buffered so it remains readable by the caller, and the full body that was read is captured into the trace. To
 // bound how many bytes are read from an untrusted endpoint, wrap the inner transport with WithReadLimit, e.g.
-// WithTraces(WithReadLimit(inner, n)). If inner is nil then http.DefaultTransport is used.
+// WithTraces(WithReadLimit(inner, n)), or to bound only how much is captured, pass TraceCaptureLimit. If inner is
+// nil then http.DefaultTransport is used.
 //
 // The transport accumulates nothing, so it belongs on the client when the client is built - including a long-lived
 // client shared across many calls, and one handed to a vendor SDK that will make the requests itself. A request
 // whose context carries no collector is passed straight through, untraced and with its body left unbuffered: nobody
 // asked for that call's trace, so none is taken and none of tracing's cost is paid.
-func WithTraces(inner http.RoundTripper) http.RoundTripper {
+func WithTraces(inner http.RoundTripper, opts ...TraceOption) http.RoundTripper {
 	if inner == nil {
 		inner = http.DefaultTransport
 	}
-	return &tracesTransport{inner: inner}
+	t := &tracesTransport{inner: inner}
+	for _, opt := range opts {
+		opt(t)
+	}
+	return t
 }
 
 func (t *tracesTransport) RoundTrip(request *http.Request) (*http.Response, error) {
@@ -131,7 +177,10 @@ func (t *tracesTransport) RoundTrip(request *http.Request) (*http.Response, erro
 		return t.inner.RoundTrip(request)
 	}
 
-	requestTrace, err := httputil.DumpRequestOut(request, true)
+	// with a capture limit we dump only the headers and capture the body as it's sent
+	streaming := t.captureLimit > 0
+
+	requestTrace, err := httputil.DumpRequestOut(request, !streaming)
 	if err != nil {
 		// the http.RoundTripper contract requires the request body to be closed even on error paths
 		if request.Body != nil {
@@ -140,27 +189,54 @@ func (t *tracesTransport) RoundTrip(request *http.Request) (*http.Response, erro
 		return nil, err
 	}
 
-	// carry a counter so that an inner retryTransport, if composed inside us, can report how many retries it made,
-	// which we then surface as Trace.Retries
-	ctx, retryCount := contextWithRetryCount(request.Context())
+	// carry stats so that inner transports composed inside us can report what they did, e.g. how many retries a
+	// retryTransport made, which we then surface on the trace
+	ctx, stats := contextWithTraceStats(request.Context())
+
+	// and hook into the client's connection lifecycle to record where the time goes
+	timings := &timingsRecorder{}
+	ctx = httptrace.WithClientTrace(ctx, timings.clientTrace())
+
 	request = request.WithContext(ctx)
 
+	var requestCapture *bodyCapture
+	if streaming && request.Body != nil && request.Body != http.NoBody {
+		requestCapture = captureRequestBody(request, t.captureLimit)
+	}
+
 	trace := &Trace{
 		Request:      request,
 		RequestTrace: requestTrace,
 		StartTime:    dates.Now(),
 	}
 
-	// hand the trace to the collector only once every field has been written. Deferring it (registered first, so it
-	// runs last) publishes it on every exit path, and the collector's lock then gives a reader in another goroutine
-	// the happens-before it needs - whereas publishing up front would expose a trace still being filled in, which
-	// only a collector that is never shared could get away with reading.
-	defer collector.add(trace)
-	defer func() { trace.EndTime = dates.Now() }()
+	// hand the trace to the collector only once every field has been written. Deferring it publishes it on every
+	// exit path, and the collector's lock then gives a reader in another goroutine the happens-before it needs -
+	// whereas publishing up front would expose a trace still being filled in, which only a collector that is never
+	// shared could get away with reading. A streamed response body takes over publishing, as the trace isn't
+	// complete until the caller has finished reading it.
+	published := false
+	defer func() {
+		if !published {
+			trace.EndTime = dates.Now()
+			collector.add(trace)
+		}
+	}()
 
 	response, err := t.inner.RoundTrip(request)
 	trace.Response = response
-	trace.Retries = int(retryCount.Load())
+	trace.Retries = int(stats.retries.Load())
+	trace.CircuitOpen = stats.circuitOpen.Load()
+	trace.RateLimitWait = time.Duration(stats.rateLimitWait.Load())
+	trace.Cache, _ = stats.cacheStatus.Load().(CacheStatus)
+	trace.Timings = timings.result()
+
+	if requestCapture != nil {
+		captured, total := requestCapture.result()
+		trace.RequestTrace = append(trace.RequestTrace, captured...)
+		trace.requestUncaptured = total - len(captured)
+	}
+
 	if err != nil {
 		// the inner transport failed to obtain a response
 		return nil, err
@@ -170,6 +246,21 @@ func (t *tracesTransport) RoundTrip(request *http.Request) (*http.Response, erro
 	// have a usable response to hand back to the caller
 	trace.ResponseTrace, _ = httputil.DumpResponse(response, false)
 
+	if streaming {
+		published = true
+		response.Body = &capturingBody{
+			inner:   response.Body,
+			capture: &bodyCapture{limit: t.captureLimit},
+			done: func(captured []byte, total int) {
+				trace.ResponseBody = captured
+				trace.responseUncaptured = total - len(captured)
+				trace.EndTime = dates.Now()
+				collector.add(trace)
+			},
+		}
+		return response, nil
+	}
+
 	// read the full body so we can both capture it and hand a readable copy back to the caller
 	body, readErr := io.ReadAll(response.Body)
 	response.Body.Close()
@@ -190,6 +281,31 @@ func (t *tracesTransport) RoundTrip(request *http.Request) (*http.Response, erro
 
 var _ http.RoundTripper = (*tracesTransport)(nil)
 
+// traceStatsKey is the unexported context key under which traceStats are carried.
+type traceStatsKey struct{}
+
+// traceStats is carried in the context of a traced request so that transports composed inside WithTraces (e.g. the
+// one built by WithRetries) can report what they did with the request, which the outer traces transport then reads
+// back when finalizing its trace.
+type traceStats struct {
+	retries       atomic.Int64
+	circuitOpen   atomic.Bool
+	rateLimitWait atomic.Int64
+	cacheStatus   atomic.Value // CacheStatus
+}
+
+// contextWithTraceStats returns a copy of ctx carrying fresh trace stats, along with those stats.
+func contextWithTraceStats(ctx context.Context) (context.Context, *traceStats) {
+	stats := &traceStats{}
+	return context.WithValue(ctx, traceStatsKey{}, stats), stats
+}
+
+// traceStatsFromContext returns the trace stats carried in ctx, or nil if none were installed.
+func traceStatsFromContext(ctx context.Context) *traceStats {
+	stats, _ := ctx.Value(traceStatsKey{}).(*traceStats)
+	return stats
+}
+
 type traceCollectorKey struct{}
 
 // TraceCollector accumulates the traces of the requests made under a particular context. A trace appears here once
@@ -252,7 +368,212 @@ func (c *TraceCollector) Last() *Trace {
 	return c.traces[len(c.traces)-1]
 }
 
+// bodyCapture keeps the first limit bytes of a body as it's read, and counts the rest. Access is synchronized as a
+// request body can be written by a transport's own goroutine.
+type bodyCapture struct {
+	mutex    sync.Mutex
+	limit    int
+	captured []byte
+	total    int
+}
+
+func (c *bodyCapture) write(p []byte) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if room := c.limit - len(c.captured); room > 0 {
+		c.captured = append(c.captured, p[:min(room, len(p))]...)
+	}
+	c.total += len(p)
+}
+
+func (c *bodyCapture) reset() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.captured = nil
+	c.total = 0
+}
+
+// result returns the captured bytes and the total number of bytes seen. A capture which was cut short has any
+// trailing partial UTF-8 sequence trimmed so that it doesn't make an otherwise valid text body look like binary.
+func (c *bodyCapture) result() ([]byte, int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	captured := c.captured
+	if c.total > len(captured) && !utf8.Valid(captured) {
+		for i := 1; i < utf8.UTFMax && i <= len(captured); i++ {
+			if utf8.Valid(captured[:len(captured)-i]) {
+				captured = captured[:len(captured)-i]
+				break
+			}
+		}
+	}
+	return captured, c.total
+}
+
+// captureRequestBody wraps the request's body, and its GetBody so that a retried request is captured too
+func captureRequestBody(request *http.Request, limit int) *bodyCapture {
+	capture := &bodyCapture{limit: limit}
+
+	request.Body = &capturingBody{inner: request.Body, capture: capture}
+
+	if getBody := request.GetBody; getBody != nil {
+		request.GetBody = func() (io.ReadCloser, error) {
+			body, err := getBody()
+			if err != nil {
+				return nil, err
+			}
+			capture.reset()
+			return &capturingBody{inner: body, capture: capture}, nil
+		}
+	}
+	return capture
+}
+
+// capturingBody is a body which captures what is read from it, calling done once when it's read to the end or
+// closed
+type capturingBody struct {
+	inner    io.ReadCloser
+	capture  *bodyCapture
+	done     func([]byte, int)
+	doneOnce sync.Once
+}
+
+func (b *capturingBody) Read(p []byte) (int, error) {
+	n, err := b.inner.Read(p)
+	b.capture.write(p[:n])
+	if err != nil {
+		b.finish()
+	}
+	return n, err
+}
+
+func (b *capturingBody) Close() error {
+	err := b.inner.Close()
+	b.finish()
+	return err
+}
+
+func (b *capturingBody) finish() {
+	if b.done != nil {
+		b.doneOnce.Do(func() { b.done(b.capture.result()) })
+	}
+}
+
 // errReader is an io.Reader that always returns its error, used to replay a body read failure to the caller
 type errReader struct{ err error }
 
 func (r errReader) Read([]byte) (int, error) { return 0, r.err }
+
+//------------------------------------------------------------------------------------------
+// JSON Encoding / Decoding
+//------------------------------------------------------------------------------------------
+
+// traceEnvelope is the JSON form of a trace. Raw traces and bodies are base64 encoded so that they're stored byte for
+// byte, and the URL is stored separately as the request trace doesn't include the scheme.
+type traceEnvelope struct {
+	URL                string        `json:"url"`
+	RequestTrace       []byte        `json:"request_trace"`
+	ResponseTrace      []byte        `json:"response_trace,omitempty"`
+	ResponseBody       []byte        `json:"response_body,omitempty"`
+	StartTime          time.Time     `json:"start_time"`
+	EndTime            time.Time     `json:"end_time"`
+	Retries            int           `json:"retries,omitempty"`
+	CircuitOpen        bool          `json:"circuit_open,omitempty"`
+	RateLimitWait      time.Duration `json:"rate_limit_wait,omitempty"`
+	Timings            *TraceTimings `json:"timings,omitempty"`
+	Cache              CacheStatus   `json:"cache,omitempty"`
+	RequestUncaptured  int           `json:"request_uncaptured,omitempty"`
+	ResponseUncaptured int           `json:"response_uncaptured,omitempty"`
+}
+
+// MarshalJSON marshals a trace so that it can be persisted and later unmarshaled back into an equivalent trace
+func (t *Trace) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&traceEnvelope{
+		URL:                t.Request.URL.String(),
+		RequestTrace:       t.RequestTrace,
+		ResponseTrace:      t.ResponseTrace,
+		ResponseBody:       t.ResponseBody,
+		StartTime:          t.StartTime,
+		EndTime:            t.EndTime,
+		Retries:            t.Retries,
+		CircuitOpen:        t.CircuitOpen,
+		RateLimitWait:      t.RateLimitWait,
+		Timings:            t.Timings,
+		Cache:              t.Cache,
+		RequestUncaptured:  t.requestUncaptured,
+		ResponseUncaptured: t.responseUncaptured,
+	})
+}
+
+// UnmarshalJSON unmarshals a trace, rebuilding its request and response objects from the raw traces. The rebuilt
+// request can be sent again, and the rebuilt response's body can be read.
+func (t *Trace) UnmarshalJSON(data []byte) error {
+	e := &traceEnvelope{}
+	if err := json.Unmarshal(data, e); err != nil {
+		return err
+	}
+
+	request, requestBody, err := readRequestTrace(e.RequestTrace)
+	if err != nil {
+		return fmt.Errorf("error reading request trace: %w", err)
+	}
+	if request.URL, err = url.Parse(e.URL); err != nil {
+		return fmt.Errorf("error parsing trace URL: %w", err)
+	}
+
+	// a request read by ReadRequest is a server request, so turn it into a client request with a rewindable body,
+	// which is sent with a content length as it's no longer of unknown length
+	request.RequestURI = ""
+	request.TransferEncoding = nil
+	request.Body = io.NopCloser(bytes.NewReader(requestBody))
+	request.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(requestBody)), nil }
+	request.ContentLength = int64(len(requestBody))
+	if len(requestBody) == 0 {
+		request.Body = http.NoBody
+	}
+
+	var response *http.Response
+	if len(e.ResponseTrace) > 0 {
+		response, err = http.ReadResponse(bufio.NewReader(bytes.NewReader(e.ResponseTrace)), request)
+		if err != nil {
+			return fmt.Errorf("error reading response trace: %w", err)
+		}
+		response.Body = io.NopCloser(bytes.NewReader(e.ResponseBody))
+	}
+
+	*t = Trace{
+		Request:            request,
+		RequestTrace:       e.RequestTrace,
+		Response:           response,
+		ResponseTrace:      e.ResponseTrace,
+		ResponseBody:       e.ResponseBody,
+		StartTime:          e.StartTime,
+		EndTime:            e.EndTime,
+		Retries:            e.Retries,
+		CircuitOpen:        e.CircuitOpen,
+		RateLimitWait:      e.RateLimitWait,
+		Timings:            e.Timings,
+		Cache:              e.Cache,
+		requestUncaptured:  e.RequestUncaptured,
+		responseUncaptured: e.ResponseUncaptured,
+	}
+	return nil
+}
+
+// readRequestTrace parses a raw request trace, returning the request and its body with any transfer encoding such as
+// chunking undone. A body which was truncated, e.g. by a trace capture limit, is read as far as possible.
+func readRequestTrace(trace []byte) (*http.Request, []byte, error) {
+	request, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(trace)))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	body, err := io.ReadAll(request.Body)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, nil, err
+	}
+	return request, body, nil
+}
@@ -2,15 +2,20 @@ package httpx_test
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"net/http/httptest"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 	"unicode/utf8"
 
+	"github.com/andybalholm/brotli"
 	"github.com/nyaruka/gocommon/dates"
 	"github.com/nyaruka/gocommon/httpx"
 	"github.com/stretchr/testify/assert"
@@ -228,6 +233,93 @@ func TestNonUTF8Response(t *testing.T) {
 	assert.True(t, utf8.Valid([]byte(sanitized)))
 }
 
+func TestEncodedBodies(t *testing.T) {
+	gzipped := &bytes.Buffer{}
+	gw := gzip.NewWriter(gzipped)
+	gw.Write([]byte(`{"status": "ok"}`))
+	gw.Close()
+
+	brotlied := &bytes.Buffer{}
+	bw := brotli.NewWriter(brotlied)
+	bw.Write([]byte(`{"status": "ok"}`))
+	bw.Close()
+
+	ctx, traces := httpx.WithTraceCollector(context.Background())
+
+	tt := httpx.WithTraces(httpx.WithMocks(http.DefaultTransport, map[string][]*httpx.MockResponse{
+		"https://temba.io": {
+			httpx.NewMockResponse(200, map[string]string{"Content-Encoding": "gzip"}, gzipped.Bytes()),
+			httpx.NewMockResponse(200, map[string]string{"Content-Encoding": "br"}, brotlied.Bytes()),
+			httpx.NewMockResponse(200, map[string]string{"Content-Encoding": "compress"}, []byte{0x1f, 0x9d}),
+		},
+	}))
+
+	request, err := httpx.NewRequest(ctx, "GET", "https://temba.io", nil, nil)
+	require.NoError(t, err)
+
+	resp, err := tt.RoundTrip(request)
+	require.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	// caller and trace both get the bytes as they were sent but the sanitized response is decoded
+	trace := traces.Last()
+	assert.Equal(t, gzipped.Bytes(), body)
+	assert.Equal(t, gzipped.Bytes(), trace.ResponseBody)
+	assert.Equal(t, "HTTP/1.0 200 OK\r\nContent-Length: 41\r\nContent-Encoding: gzip\r\n\r\n{\"status\": \"ok\"}", trace.SanitizedResponse("..."))
+
+	// brotli is built in too
+	request, err = httpx.NewRequest(ctx, "GET", "https://temba.io", nil, nil)
+	require.NoError(t, err)
+
+	resp, err = tt.RoundTrip(request)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, fmt.Sprintf("HTTP/1.0 200 OK\r\nContent-Length: %d\r\nContent-Encoding: br\r\n\r\n{\"status\": \"ok\"}", brotlied.Len()), traces.Last().SanitizedResponse("..."))
+
+	// an encoding we can't decode is left as is
+	request, err = httpx.NewRequest(ctx, "GET", "https://temba.io", nil, nil)
+	require.NoError(t, err)
+
+	resp, err = tt.RoundTrip(request)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, "HTTP/1.0 200 OK\r\nContent-Length: 2\r\nContent-Encoding: compress\r\n\r\n...", traces.Last().SanitizedResponse("..."))
+
+	// a truncated body is decoded as far as possible
+	decoded, err := httpx.DecodeContent(gzipped.Bytes()[:30], "gzip")
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(`{"status": "ok"}`, string(decoded)))
+
+	_, err = httpx.DecodeContent([]byte("abc"), "gzip")
+	assert.EqualError(t, err, "error decoding gzip content: unexpected EOF")
+
+	_, err = httpx.DecodeContent([]byte("abc"), "compress")
+	assert.EqualError(t, err, "unsupported content encoding: compress")
+
+	decoded, err = httpx.DecodeContent([]byte("abc"), "identity")
+	assert.NoError(t, err)
+	assert.Equal(t, "abc", string(decoded))
+
+	// decoders can be registered for other encodings
+	httpx.RegisterContentDecoder("x-upper", func(r io.Reader) (io.Reader, error) {
+		b, err := io.ReadAll(r)
+		return bytes.NewReader(bytes.ToLower(b)), err
+	})
+
+	upper := &bytes.Buffer{}
+	gw = gzip.NewWriter(upper)
+	gw.Write([]byte(`HELLO`))
+	gw.Close()
+
+	// encodings are undone in reverse order
+	decoded, err = httpx.DecodeContent(upper.Bytes(), "x-upper, gzip")
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(decoded))
+}
+
 // roundTripFunc adapts a function to an http.RoundTripper for tests.
 type roundTripFunc func(*http.Request) (*http.Response, error)
 
@@ -402,3 +494,227 @@ func TestTraceCollectorSharedContext(t *testing.T) {
 		assert.False(t, tr.EndTime.IsZero())
 	}
 }
+
+func TestTraceTimings(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(10 * time.Millisecond)
+		w.Write([]byte("OK"))
+	}))
+	defer server.Close()
+
+	transport := httpx.WithTraces(server.Client().Transport)
+
+	call := func() *httpx.Trace {
+		ctx, traces := httpx.WithTraceCollector(context.Background())
+		req, err := httpx.NewRequest(ctx, "GET", server.URL, nil, nil)
+		require.NoError(t, err)
+		resp, err := transport.RoundTrip(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return traces.Last()
+	}
+
+	// first request has to make a new connection
+	trace := call()
+	require.NotNil(t, trace.Timings)
+	assert.False(t, trace.Timings.ConnReused)
+	assert.Equal(t, time.Duration(0), trace.Timings.DNS) // no lookup for an IP address
+	assert.Greater(t, trace.Timings.Connect, time.Duration(0))
+	assert.Greater(t, trace.Timings.TLS, time.Duration(0))
+	assert.GreaterOrEqual(t, trace.Timings.FirstByte, 10*time.Millisecond+trace.Timings.Connect+trace.Timings.TLS)
+
+	log := httpx.NewLog(trace, 2048, 10000, nil)
+	require.NotNil(t, log.Timings)
+	assert.GreaterOrEqual(t, log.Timings.FirstByteMS, 10)
+	assert.False(t, log.Timings.ConnReused)
+
+	har := httpx.NewHAR([]*httpx.Trace{trace}, nil)
+	assert.Greater(t, har.Log.Entries[0].Timings.SSL, float64(0))
+	assert.Greater(t, har.Log.Entries[0].Timings.Connect, har.Log.Entries[0].Timings.SSL)
+	assert.GreaterOrEqual(t, har.Log.Entries[0].Timings.Wait, float64(10))
+
+	// second can reuse it
+	trace = call()
+	require.NotNil(t, trace.Timings)
+	assert.True(t, trace.Timings.ConnReused)
+	assert.Equal(t, time.Duration(0), trace.Timings.Connect)
+	assert.Equal(t, time.Duration(0), trace.Timings.TLS)
+	assert.GreaterOrEqual(t, trace.Timings.FirstByte, 10*time.Millisecond)
+
+	har = httpx.NewHAR([]*httpx.Trace{trace}, nil)
+	assert.Equal(t, float64(-1), har.Log.Entries[0].Timings.Connect)
+	assert.Equal(t, float64(-1), har.Log.Entries[0].Timings.SSL)
+
+	// a request that never needs a connection has no timings
+	transport = httpx.WithTraces(httpx.WithMocks(nil, map[string][]*httpx.MockResponse{
+		server.URL: {httpx.NewMockResponse(200, nil, nil)},
+	}))
+	trace = call()
+	assert.Nil(t, trace.Timings)
+	assert.Nil(t, httpx.NewLog(trace, 2048, 10000, nil).Timings)
+}
+
+func TestTraceCaptureLimit(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Write(bytes.Repeat([]byte("abcdefghij"), 1000))
+	}))
+	defer server.Close()
+
+	transport := httpx.WithTraces(httpx.WithRetries(nil, httpx.NewFixedRetries()), httpx.TraceCaptureLimit(15))
+
+	ctx, traces := httpx.WithTraceCollector(context.Background())
+	req, err := httpx.NewRequest(ctx, "POST", server.URL, strings.NewReader(strings.Repeat("0123456789", 100)), nil)
+	require.NoError(t, err)
+	resp, err := transport.RoundTrip(req)
+	require.NoError(t, err)
+
+	// trace isn't complete until the body has been read, so isn't collected until then
+	assert.Nil(t, traces.Last())
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Len(t, body, 10000) // caller still gets the full body
+	resp.Body.Close()
+
+	trace := traces.Last()
+	require.NotNil(t, trace)
+	assert.Equal(t, "abcdefghijabcde", string(trace.ResponseBody))
+	assert.Equal(t, len(trace.ResponseTrace)+10000, trace.ResponseSize())
+	assert.True(t, strings.HasSuffix(string(trace.RequestTrace), "\r\n\r\n012345678901234"))
+	assert.Equal(t, len(trace.RequestTrace)-15+1000, trace.RequestSize())
+	assert.False(t, trace.EndTime.IsZero())
+	assert.Len(t, traces.Traces(), 1)
+
+	// closing the body without reading it also completes the trace
+	ctx, traces = httpx.WithTraceCollector(context.Background())
+	req, _ = httpx.NewRequest(ctx, "GET", server.URL, nil, nil)
+	resp, err = transport.RoundTrip(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.NotNil(t, traces.Last())
+	assert.Equal(t, "", string(traces.Last().ResponseBody))
+
+	// a body which is cut short mid-character doesn't end up looking like binary
+	transport = httpx.WithTraces(httpx.WithMocks(nil, map[string][]*httpx.MockResponse{
+		server.URL: {httpx.NewMockResponse(200, nil, []byte("hello 👋 world"))},
+	}), httpx.TraceCaptureLimit(8))
+	ctx, traces = httpx.WithTraceCollector(context.Background())
+	req, _ = httpx.NewRequest(ctx, "GET", server.URL, nil, nil)
+	resp, err = transport.RoundTrip(req)
+	require.NoError(t, err)
+	io.ReadAll(resp.Body)
+	assert.Equal(t, "hello ", string(traces.Last().ResponseBody))
+	assert.True(t, strings.HasSuffix(traces.Last().SanitizedResponse("..."), "hello "))
+}
+
+func TestTraceMarshaling(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Binary", "yes")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write([]byte{'{', '}', '\xc3', '\x28'})
+	}))
+	defer server.Close()
+
+	transport := httpx.WithTraces(nil, httpx.TraceCaptureLimit(3))
+
+	ctx, traces := httpx.WithTraceCollector(context.Background())
+	req, err := httpx.NewRequest(ctx, "POST", server.URL+"/send?x=1", strings.NewReader(`{"text":"hi"}`), map[string]string{"Content-Type": "application/json"})
+	require.NoError(t, err)
+	resp, err := transport.RoundTrip(req)
+	require.NoError(t, err)
+	io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	// and a request which fails to connect
+	req, _ = httpx.NewRequest(ctx, "GET", "http://127.0.0.1:1/nothing", nil, nil)
+	_, err = transport.RoundTrip(req)
+	require.Error(t, err)
+
+	original := traces.Traces()
+	require.Len(t, original, 2)
+
+	marshaled, err := json.Marshal(original)
+	require.NoError(t, err)
+
+	var loaded []*httpx.Trace
+	require.NoError(t, json.Unmarshal(marshaled, &loaded))
+	require.Len(t, loaded, 2)
+
+	trace := loaded[0]
+	assert.Equal(t, original[0].RequestTrace, trace.RequestTrace)
+	assert.Equal(t, original[0].ResponseTrace, trace.ResponseTrace)
+	assert.Equal(t, original[0].ResponseBody, trace.ResponseBody)
+	assert.True(t, original[0].StartTime.Equal(trace.StartTime))
+	assert.True(t, original[0].EndTime.Equal(trace.EndTime))
+	assert.Equal(t, original[0].Timings, trace.Timings)
+	assert.Equal(t, original[0].RequestSize(), trace.RequestSize())
+	assert.Equal(t, original[0].ResponseSize(), trace.ResponseSize())
+	assert.Equal(t, original[0].SanitizedRequest("..."), trace.SanitizedRequest("..."))
+	assert.Equal(t, original[0].SanitizedResponse("..."), trace.SanitizedResponse("..."))
+
+	// request and response objects are rebuilt
+	assert.Equal(t, "POST", trace.Request.Method)
+	assert.Equal(t, server.URL+"/send?x=1", trace.Request.URL.String())
+	assert.Equal(t, "application/json", trace.Request.Header.Get("Content-Type"))
+	assert.Equal(t, 422, trace.Response.StatusCode)
+	assert.Equal(t, "yes", trace.Response.Header.Get("X-Binary"))
+
+	assert.Nil(t, loaded[1].Response)
+	assert.Equal(t, "http://127.0.0.1:1/nothing", loaded[1].Request.URL.String())
+
+	// and can be replayed as mocks to reproduce what happened
+	mocks := httpx.WithMocks(nil, httpx.NewMocksFromTraces(loaded))
+
+	ctx, traces = httpx.WithTraceCollector(context.Background())
+	resp, err = httpx.WithTraces(mocks).RoundTrip(loaded[0].Request.Clone(ctx))
+	require.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, 422, resp.StatusCode)
+	assert.Equal(t, "yes", resp.Header.Get("X-Binary"))
+	assert.Equal(t, []byte{'{', '}'}, body) // only what was captured
+	assert.True(t, strings.HasSuffix(string(traces.Last().RequestTrace), "\r\n\r\n{\"t"))
+
+	_, err = mocks.RoundTrip(loaded[1].Request)
+	assert.EqualError(t, err, "unable to connect to server")
+	assert.False(t, mocks.HasUnused())
+}
+
+func TestTraceMarshalingChunked(t *testing.T) {
+	var received []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		received = append(received, string(b))
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	// a body of unknown length is sent chunked
+	ctx, traces := httpx.WithTraceCollector(context.Background())
+	req, err := httpx.NewRequest(ctx, "POST", server.URL, struct{ io.Reader }{strings.NewReader("hello world")}, map[string]string{"Content-Type": "text/plain"})
+	require.NoError(t, err)
+	resp, err := httpx.WithTraces(nil).RoundTrip(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Contains(t, string(traces.Last().RequestTrace), "Transfer-Encoding: chunked")
+
+	marshaled, err := json.Marshal(traces.Last())
+	require.NoError(t, err)
+
+	loaded := &httpx.Trace{}
+	require.NoError(t, json.Unmarshal(marshaled, loaded))
+
+	// the rebuilt request has the body without the chunked framing, so it can be sent again as it was
+	resp, err = http.DefaultTransport.RoundTrip(loaded.Request)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, []string{"hello world", "hello world"}, received)
+	assert.Equal(t, int64(11), loaded.Request.ContentLength)
+
+	// and the same goes for HAR post data
+	har := httpx.NewHAR([]*httpx.Trace{traces.Last()}, nil)
+	assert.Equal(t, &httpx.HARPostData{MimeType: "text/plain", Text: "hello world"}, har.Log.Entries[0].Request.PostData)
+}
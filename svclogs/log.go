@@ -47,11 +47,14 @@ type Log struct {
 
 	recorder *httpx.Recorder
 	redactor stringsx.Redactor
+	logOpts  []httpx.LogOption
 }
 
 // New creates a new log of the given type. Pass a recorder when the interaction was triggered by an incoming request
 // which should itself be included in the log, and the values (tokens, secrets) to redact from everything added to it.
-func New(t Type, r *httpx.Recorder, redactVals []string) *Log {
+// Options such as httpx.RedactHeaders add structured redaction of values which aren't known in advance to the HTTP
+// logs.
+func New(t Type, r *httpx.Recorder, redactVals []string, opts ...httpx.LogOption) *Log {
 	return &Log{
 		UUID:      NewUUID(),
 		Type:      t,
@@ -61,6 +64,7 @@ func New(t Type, r *httpx.Recorder, redactVals []string) *Log {
 
 		recorder: r,
 		redactor: stringsx.NewRedactor("**********", redactVals...),
+		logOpts:  opts,
 	}
 }
 
@@ -101,5 +105,5 @@ func (l *Log) IsError() bool {
 }
 
 func (l *Log) traceToLog(t *httpx.Trace) *httpx.Log {
-	return httpx.NewLog(t, 2048, 50000, l.redactor)
+	return httpx.NewLog(t, 2048, 50000, l.redactor, l.logOpts...)
 }
@@ -15,8 +15,9 @@ import (
 func TestLogs(t *testing.T) {
 	// tracing is installed once on the shared client; each call collects its own traces via the context
 	client := &http.Client{Transport: httpx.WithTraces(httpx.WithMocks(nil, map[string][]*httpx.MockResponse{
-		"http://ivr.com/start":  {httpx.NewMockResponse(200, nil, []byte("OK"))},
-		"http://ivr.com/hangup": {httpx.NewMockResponse(400, nil, []byte("Oops"))},
+		"http://ivr.com/start":   {httpx.NewMockResponse(200, nil, []byte("OK"))},
+		"http://ivr.com/hangup":  {httpx.NewMockResponse(400, nil, []byte("Oops"))},
+		"http://ivr.com/status*": {httpx.NewMockResponse(200, nil, []byte("OK"))},
 	}))}
 
 	do := func(t *testing.T, method, url string, headers map[string]string) *httpx.Trace {
@@ -59,4 +60,14 @@ func TestLogs(t *testing.T) {
 	assert.Equal(t, "code1", log3.Errors[0].Code)
 	assert.Equal(t, "ext", log3.Errors[0].ExtCode)
 	assert.True(t, log3.IsError())
+
+	// log options add structured redaction of values which aren't known in advance
+	log4 := svclogs.New("type3", nil, nil, httpx.RedactHeaders("Authorization"), httpx.RedactQueryParams("access_token"))
+	log4.HTTP(do(t, "GET", "http://ivr.com/status?access_token=xyz123", map[string]string{"Authorization": "Bearer abc456"}))
+	log4.End()
+
+	assert.Equal(t, "http://ivr.com/status?access_token=**********", log4.HttpLogs[0].URL)
+	assert.NotContains(t, log4.HttpLogs[0].Request, "xyz123")
+	assert.NotContains(t, log4.HttpLogs[0].Request, "abc456")
+	assert.Contains(t, log4.HttpLogs[0].Request, "Authorization: **********")
 }
@@ -0,0 +1,59 @@
+package svclogs
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/nyaruka/gocommon/httpx"
+)
+
+type logKey struct{}
+
+// Sink receives the finished log of each request handled by Middleware, e.g. to write it to a database
+type Sink func(context.Context, *Log)
+
+// FromContext returns the log attached to the given context by Middleware, or nil if there isn't one
+func FromContext(ctx context.Context) *Log {
+	l, _ := ctx.Value(logKey{}).(*Log)
+	return l
+}
+
+// Middleware returns middleware which records each incoming request in a new log of the given type, redacting the given
+// values and applying the given log options as New does. The log is attached to the request context so that handlers
+// can add errors to it with FromContext, along with a trace collector so that requests the handler makes with a tracing
+// transport (see httpx.WithTraces) are added to it automatically. Once the handler has returned, the finished log is
+// passed to the sink with a context that isn't cancelled when the request ends. If sink is nil then finished logs are
+// discarded.
+//
+//	r := chi.NewRouter()
+//	r.Use(svclogs.Middleware("channel_callback", nil, func(ctx context.Context, l *svclogs.Log) { ... }))
+func Middleware(t Type, redactVals []string, sink Sink, opts ...httpx.LogOption) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			recorder, err := httpx.NewRecorder(r, w, true)
+			if err != nil {
+				http.Error(w, "unable to read request", http.StatusBadRequest)
+				return
+			}
+
+			log := New(t, recorder, redactVals, opts...)
+
+			ctx, traces := httpx.WithTraceCollector(r.Context())
+			ctx = context.WithValue(ctx, logKey{}, log)
+
+			next.ServeHTTP(recorder.ResponseWriter, r.WithContext(ctx))
+
+			if err := recorder.End(); err != nil {
+				log.Error(&Error{Code: "recorder", Message: err.Error()})
+			}
+			for _, trace := range traces.Traces() {
+				log.HTTP(trace)
+			}
+			log.End()
+
+			if sink != nil {
+				sink(context.WithoutCancel(ctx), log)
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package svclogs_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/nyaruka/gocommon/httpx"
+	"github.com/nyaruka/gocommon/svclogs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMiddleware(t *testing.T) {
+	client := &http.Client{Transport: httpx.WithTraces(httpx.WithMocks(nil, map[string][]*httpx.MockResponse{
+		"http://ivr.com/status": {httpx.NewMockResponse(200, nil, []byte("OK"))},
+	}))}
+
+	var logs []*svclogs.Log
+	sink := func(ctx context.Context, l *svclogs.Log) {
+		assert.NoError(t, ctx.Err())
+		logs = append(logs, l)
+	}
+
+	handler := svclogs.Middleware("callback", []string{"sesame"}, sink, httpx.RedactHeaders("X-Api-Key"))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log := svclogs.FromContext(r.Context())
+		require.NotNil(t, log)
+
+		// outgoing requests made with the request context are added to the log
+		req, _ := httpx.NewRequest(r.Context(), "GET", "http://ivr.com/status", nil, map[string]string{"Authorization": "Token sesame", "X-Api-Key": "abc456"})
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+
+		log.Error(&svclogs.Error{Code: "bad_thing", Message: "couldn't find sesame"})
+
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte(`received`))
+	}))
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	resp, err := http.Post(server.URL+"/callback", "text/plain", strings.NewReader("hello"))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+	require.Len(t, logs, 1)
+	log := logs[0]
+	assert.Equal(t, svclogs.Type("callback"), log.Type)
+
+	// incoming request is first, followed by the outgoing one
+	require.Len(t, log.HttpLogs, 2)
+	assert.Equal(t, server.URL+"/callback", log.HttpLogs[0].URL)
+	assert.Equal(t, http.StatusAccepted, log.HttpLogs[0].StatusCode)
+	assert.Contains(t, log.HttpLogs[0].Request, "hello")
+	assert.Contains(t, log.HttpLogs[0].Response, "received")
+	assert.Equal(t, "http://ivr.com/status", log.HttpLogs[1].URL)
+	assert.NotContains(t, log.HttpLogs[1].Request, "sesame")
+	assert.NotContains(t, log.HttpLogs[1].Request, "abc456")
+
+	require.Len(t, log.Errors, 1)
+	assert.Equal(t, "couldn't find **********", log.Errors[0].Message)
+
+	assert.Nil(t, svclogs.FromContext(context.Background()))
+
+	// a nil sink discards logs
+	handler = svclogs.Middleware("callback", nil, nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.NotNil(t, svclogs.FromContext(r.Context()))
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("POST", "/callback", strings.NewReader("hello")))
+	assert.Equal(t, http.StatusOK, rec.Code)
+}